@@ -0,0 +1,570 @@
+package hamt
+
+import (
+	"sync/atomic"
+)
+
+// ConcurrentMap map safe for concurrent use, a Ctrie (Prokopec et al., "Concurrent Tries with Efficient
+// Non-Blocking Snapshots") whose AMT nodes are indexed by bitmap like Map.
+// Every AMT node hangs below an indirection node (I-node), and writers replace the AMT node of one I-node
+// by CAS, so writers of disjoint keys don't conflict unless they change the same AMT node.
+// Readers atomically load pointers along the path and never block.
+// Snapshot takes O(1) by starting a new generation of I-nodes at root, I-nodes of older generations are then
+// copied lazily by the first writer passing by. Each CAS on an I-node is a GCAS, which only succeeds if no
+// snapshot is taken meanwhile.
+// NOTE: nodes live in GC managed memory rather than qfmalloc, since readers may still be traversing nodes
+// replaced by writers, so they can't be freed explicitly.
+type ConcurrentMap[K, V any] struct {
+	root     atomic.Pointer[rootRef[K, V]]
+	hasher   Hasher[K]
+	readOnly bool // set for internal snapshot used by Count and Range
+}
+
+// rootRef root of Ctrie, it's an I-node or RDCSS descriptor while a snapshot is replacing the root
+type rootRef[K, V any] struct {
+	in   *iNode[K, V]
+	desc *rdcssDesc[K, V]
+}
+
+// rdcssDesc descriptor of RDCSS replacing root old with next if main node of old is still expected
+type rdcssDesc[K, V any] struct {
+	old       *rootRef[K, V]
+	expected  *mainNode[K, V]
+	next      *rootRef[K, V]
+	committed atomic.Bool
+}
+
+// generation of I-nodes, I-node of another generation than the root is copied before it's changed
+type generation struct {
+	_ int // non-zero size so that each generation has its own address
+}
+
+// iNode indirection node, its main node is replaced by GCAS on every change below it
+type iNode[K, V any] struct {
+	main atomic.Pointer[mainNode[K, V]]
+	gen  *generation
+}
+
+// mainNode node below I-node, it's one of:
+//   - C-node: AMT node whose branches are I-nodes or leaves
+//   - T-node: tomb of I-node with a single leaf, which is merged into parent by the next writer passing by
+//   - L-node: bucket of leaves with conflict hash when hash runs out
+//   - failed node: marker of aborted GCAS, set as prev of the main node it tried to install
+type mainNode[K, V any] struct {
+	bitmap   bitmap
+	branches []branch[K, V]
+	gen      *generation // of C-node
+	tomb     *sNode[K, V]
+	bucket   []*sNode[K, V]
+	failed   bool
+	// prev main node replaced by GCAS until it's committed, or failed node if it's aborted
+	prev atomic.Pointer[mainNode[K, V]]
+}
+
+// branch of C-node, either I-node or leaf
+type branch[K, V any] struct {
+	in   *iNode[K, V]
+	leaf *sNode[K, V]
+}
+
+// sNode leaf holding key/val and hash of key
+type sNode[K, V any] struct {
+	key  *K
+	val  *V
+	hash uint64
+}
+
+// NewConcurrent create an empty concurrent map using hasher h for hash and equality of keys
+func NewConcurrent[K, V any](h Hasher[K]) *ConcurrentMap[K, V] {
+	gen := new(generation)
+	m := &ConcurrentMap[K, V]{hasher: h}
+	m.root.Store(&rootRef[K, V]{in: newINode(&mainNode[K, V]{gen: gen}, gen)})
+	return m
+}
+
+// NewConcurrentMap create an empty concurrent map of Key/Value
+func NewConcurrentMap() *ConcurrentMap[Key, Value] {
+	return NewConcurrent[Key, Value](NewKeyHasher())
+}
+
+// Count number of keys in a snapshot of map, which walks the whole trie
+func (m *ConcurrentMap[K, V]) Count() int {
+	n := 0
+	m.Range(func(*K, *V) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func (m *ConcurrentMap[K, V]) Find(k *K) *V {
+	hash := m.hasher.Hash(*k)
+	for {
+		root := m.readRoot(false)
+		if v, restart := m.lookup(root, k, hash); !restart {
+			return v
+		}
+	}
+}
+
+func (m *ConcurrentMap[K, V]) Add(k *K, v *V) {
+	hash := m.hasher.Hash(*k)
+	for {
+		root := m.readRoot(false)
+		if !m.insert(root, k, v, hash) {
+			return
+		}
+	}
+}
+
+// Delete remove key from map and return its value if exists
+func (m *ConcurrentMap[K, V]) Delete(k *K) (*V, bool) {
+	hash := m.hasher.Hash(*k)
+	for {
+		root := m.readRoot(false)
+		if v, found, restart := m.remove(root, k, hash, 0, nil, root.gen); !restart {
+			return v, found
+		}
+	}
+}
+
+// Snapshot return a consistent copy of map in O(1), both of them can be modified independently afterward
+func (m *ConcurrentMap[K, V]) Snapshot() *ConcurrentMap[K, V] {
+	for {
+		root := m.readRootRef(false)
+		main := m.gcasRead(root.in)
+		if m.rdcssRoot(root, main, &rootRef[K, V]{in: m.copyToGen(root.in, new(generation))}) {
+			s := &ConcurrentMap[K, V]{hasher: m.hasher}
+			s.root.Store(&rootRef[K, V]{in: m.copyToGen(root.in, new(generation))})
+			return s
+		}
+	}
+}
+
+// Range call fn for each key/value in a snapshot of map until fn returns false.
+func (m *ConcurrentMap[K, V]) Range(fn func(k *K, v *V) bool) {
+	s := m.readOnlySnapshot()
+	s.walk(s.readRoot(false), fn)
+}
+
+// readOnlySnapshot snapshot sharing I-nodes of the old generation with map, which must not be modified
+func (m *ConcurrentMap[K, V]) readOnlySnapshot() *ConcurrentMap[K, V] {
+	if m.readOnly {
+		return m
+	}
+	for {
+		root := m.readRootRef(false)
+		main := m.gcasRead(root.in)
+		if m.rdcssRoot(root, main, &rootRef[K, V]{in: m.copyToGen(root.in, new(generation))}) {
+			s := &ConcurrentMap[K, V]{hasher: m.hasher, readOnly: true}
+			s.root.Store(root)
+			return s
+		}
+	}
+}
+
+// lookup search k from root, restart is true if it has to be retried
+func (m *ConcurrentMap[K, V]) lookup(in *iNode[K, V], k *K, hash uint64) (v *V, restart bool) {
+	var parent *iNode[K, V]
+	gen := in.gen
+	for shiftBits := uint(0); ; {
+		main := m.gcasRead(in)
+		switch {
+		case main.tomb != nil:
+			if m.readOnly {
+				return m.leafValue(main.tomb, k, hash), false
+			}
+			m.clean(parent, shiftBits-symbolWidth)
+			return nil, true
+
+		case main.bucket != nil:
+			for _, l := range main.bucket {
+				if m.hasher.Equal(*l.key, *k) {
+					return l.val, false
+				}
+			}
+			return nil, false
+		}
+
+		symbol := hash >> shiftBits & hashSymbolMask
+		if !main.bitmap.isSet(symbol) {
+			return nil, false
+		}
+		br := main.branches[main.bitmap.countBelow(symbol)]
+		if br.leaf != nil {
+			return m.leafValue(br.leaf, k, hash), false
+		}
+		if m.readOnly || br.in.gen == gen {
+			parent, in, shiftBits = in, br.in, shiftBits+symbolWidth
+			continue
+		}
+		// I-node of old generation is copied before going down
+		if !m.gcas(in, main, m.renewed(main, gen)) {
+			return nil, true
+		}
+	}
+}
+
+// insert add k/v below root, return true if it has to be retried
+func (m *ConcurrentMap[K, V]) insert(in *iNode[K, V], k *K, v *V, hash uint64) (restart bool) {
+	var parent *iNode[K, V]
+	gen := in.gen
+	for shiftBits := uint(0); ; {
+		main := m.gcasRead(in)
+		switch {
+		case main.tomb != nil:
+			m.clean(parent, shiftBits-symbolWidth)
+			return true
+
+		case main.bucket != nil:
+			leaf := &sNode[K, V]{key: k, val: v, hash: hash}
+			bucket := make([]*sNode[K, V], 0, len(main.bucket)+1)
+			for _, l := range main.bucket {
+				if m.hasher.Equal(*l.key, *k) {
+					leaf.key = l.key
+				} else {
+					bucket = append(bucket, l)
+				}
+			}
+			return !m.gcas(in, main, &mainNode[K, V]{bucket: append(bucket, leaf)})
+		}
+
+		symbol := hash >> shiftBits & hashSymbolMask
+		index := main.bitmap.countBelow(symbol)
+		if !main.bitmap.isSet(symbol) {
+			cn := m.renewedFor(main, in.gen)
+			return !m.gcas(in, main, cn.inserted(symbol, index, branch[K, V]{leaf: &sNode[K, V]{key: k, val: v, hash: hash}}, in.gen))
+		}
+
+		br := main.branches[index]
+		if br.in != nil {
+			if br.in.gen == gen {
+				parent, in, shiftBits = in, br.in, shiftBits+symbolWidth
+				continue
+			}
+			if !m.gcas(in, main, m.renewed(main, gen)) {
+				return true
+			}
+			continue
+		}
+
+		l := br.leaf
+		if l.hash == hash && m.hasher.Equal(*l.key, *k) {
+			return !m.gcas(in, main, main.updated(index, branch[K, V]{leaf: &sNode[K, V]{key: l.key, val: v, hash: hash}}, in.gen))
+		}
+		cn := m.renewedFor(main, in.gen)
+		sub := newINode(dual(l, &sNode[K, V]{key: k, val: v, hash: hash}, shiftBits+symbolWidth, in.gen), in.gen)
+		return !m.gcas(in, main, cn.updated(index, branch[K, V]{in: sub}, in.gen))
+	}
+}
+
+// remove delete k from sub-trie of I-node in at shiftBits, return its value, whether it's found, and whether it
+// has to be retried from root. I-node left with a single leaf is entombed, and merged into its parent.
+func (m *ConcurrentMap[K, V]) remove(in *iNode[K, V], k *K, hash uint64, shiftBits uint, parent *iNode[K, V],
+	gen *generation) (v *V, found, restart bool) {
+	main := m.gcasRead(in)
+	switch {
+	case main.tomb != nil:
+		m.clean(parent, shiftBits-symbolWidth)
+		return nil, false, true
+
+	case main.bucket != nil:
+		bucket := make([]*sNode[K, V], 0, len(main.bucket))
+		for _, l := range main.bucket {
+			if m.hasher.Equal(*l.key, *k) {
+				v, found = l.val, true
+			} else {
+				bucket = append(bucket, l)
+			}
+		}
+		if !found {
+			return nil, false, false
+		}
+		next := &mainNode[K, V]{bucket: bucket}
+		if len(bucket) == 1 {
+			next = &mainNode[K, V]{tomb: bucket[0]}
+		}
+		if !m.gcas(in, main, next) {
+			return nil, false, true
+		}
+		return v, true, false
+	}
+
+	symbol := hash >> shiftBits & hashSymbolMask
+	if !main.bitmap.isSet(symbol) {
+		return nil, false, false
+	}
+	index := main.bitmap.countBelow(symbol)
+	br := main.branches[index]
+	switch {
+	case br.in != nil && br.in.gen == gen:
+		v, found, restart = m.remove(br.in, k, hash, shiftBits+symbolWidth, in, gen)
+	case br.in != nil:
+		if !m.gcas(in, main, m.renewed(main, gen)) {
+			return nil, false, true
+		}
+		return m.remove(in, k, hash, shiftBits, parent, gen)
+	case br.leaf.hash != hash || !m.hasher.Equal(*br.leaf.key, *k):
+		return nil, false, false
+	default:
+		next := main.removed(symbol, index, in.gen).contracted(shiftBits)
+		if !m.gcas(in, main, next) {
+			return nil, false, true
+		}
+		v, found = br.leaf.val, true
+	}
+
+	if found && parent != nil {
+		// never entomb root
+		if main := m.gcasRead(in); main.tomb != nil {
+			m.cleanParent(parent, in, hash, shiftBits-symbolWidth, gen)
+		}
+	}
+	return v, found, restart
+}
+
+// clean compress C-node of I-node in at shiftBits, merging its entombed children into it
+func (m *ConcurrentMap[K, V]) clean(in *iNode[K, V], shiftBits uint) {
+	main := m.gcasRead(in)
+	if main.tomb != nil || main.bucket != nil {
+		return
+	}
+	branches := make([]branch[K, V], len(main.branches))
+	for i, br := range main.branches {
+		if br.in != nil {
+			if sub := m.gcasRead(br.in); sub.tomb != nil {
+				br = branch[K, V]{leaf: sub.tomb}
+			}
+		}
+		branches[i] = br
+	}
+	cn := &mainNode[K, V]{bitmap: main.bitmap, branches: branches, gen: in.gen}
+	m.gcas(in, main, cn.contracted(shiftBits))
+}
+
+// cleanParent replace entombed child I-node in of parent at shiftBits with its leaf
+func (m *ConcurrentMap[K, V]) cleanParent(parent, in *iNode[K, V], hash uint64, shiftBits uint, gen *generation) {
+	for {
+		tomb := m.gcasRead(in)
+		main := m.gcasRead(parent)
+		if main.tomb != nil || main.bucket != nil {
+			return
+		}
+		symbol := hash >> shiftBits & hashSymbolMask
+		if !main.bitmap.isSet(symbol) {
+			return
+		}
+		index := main.bitmap.countBelow(symbol)
+		if main.branches[index].in != in || tomb.tomb == nil {
+			return
+		}
+		next := main.updated(index, branch[K, V]{leaf: tomb.tomb}, in.gen).contracted(shiftBits)
+		if m.gcas(parent, main, next) || m.readRoot(false).gen != gen {
+			return
+		}
+	}
+}
+
+// walk visit sub-trie of I-node in depth-first, return false if stopped by fn
+func (m *ConcurrentMap[K, V]) walk(in *iNode[K, V], fn func(k *K, v *V) bool) bool {
+	main := m.gcasRead(in)
+	switch {
+	case main.tomb != nil:
+		return fn(main.tomb.key, main.tomb.val)
+	case main.bucket != nil:
+		for _, l := range main.bucket {
+			if !fn(l.key, l.val) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, br := range main.branches {
+		if br.leaf != nil {
+			if !fn(br.leaf.key, br.leaf.val) {
+				return false
+			}
+		} else if !m.walk(br.in, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *ConcurrentMap[K, V]) leafValue(l *sNode[K, V], k *K, hash uint64) *V {
+	if l.hash == hash && m.hasher.Equal(*l.key, *k) {
+		return l.val
+	}
+	return nil
+}
+
+// readRoot root I-node, RDCSS in progress is completed first, or aborted if abort is true
+func (m *ConcurrentMap[K, V]) readRoot(abort bool) *iNode[K, V] {
+	return m.readRootRef(abort).in
+}
+
+func (m *ConcurrentMap[K, V]) readRootRef(abort bool) *rootRef[K, V] {
+	r := m.root.Load()
+	if r.desc == nil {
+		return r
+	}
+	return m.completeRoot(abort)
+}
+
+// completeRoot complete or abort RDCSS in progress, and return the root afterward
+func (m *ConcurrentMap[K, V]) completeRoot(abort bool) *rootRef[K, V] {
+	for {
+		r := m.root.Load()
+		if r.desc == nil {
+			return r
+		}
+		d := r.desc
+		if !abort && m.gcasRead(d.old.in) == d.expected {
+			if m.root.CompareAndSwap(r, d.next) {
+				d.committed.Store(true)
+				return d.next
+			}
+			continue
+		}
+		if m.root.CompareAndSwap(r, d.old) {
+			return d.old
+		}
+	}
+}
+
+// rdcssRoot replace root old with next if main node of old is still expected
+func (m *ConcurrentMap[K, V]) rdcssRoot(old *rootRef[K, V], expected *mainNode[K, V], next *rootRef[K, V]) bool {
+	d := &rootRef[K, V]{desc: &rdcssDesc[K, V]{old: old, expected: expected, next: next}}
+	if !m.root.CompareAndSwap(old, d) {
+		return false
+	}
+	m.completeRoot(false)
+	return d.desc.committed.Load()
+}
+
+// gcas replace main node of I-node in from old to next, unless a snapshot is taken before it's committed
+func (m *ConcurrentMap[K, V]) gcas(in *iNode[K, V], old, next *mainNode[K, V]) bool {
+	next.prev.Store(old)
+	if !in.main.CompareAndSwap(old, next) {
+		return false
+	}
+	m.gcasCommit(in, next)
+	return next.prev.Load() == nil
+}
+
+// gcasRead main node of I-node in, GCAS in progress is committed or aborted first
+func (m *ConcurrentMap[K, V]) gcasRead(in *iNode[K, V]) *mainNode[K, V] {
+	main := in.main.Load()
+	if main.prev.Load() == nil {
+		return main
+	}
+	return m.gcasCommit(in, main)
+}
+
+// gcasCommit commit GCAS which installed main if root is still of the generation of I-node in,
+// otherwise roll back to the previous main node. Return the main node afterward.
+func (m *ConcurrentMap[K, V]) gcasCommit(in *iNode[K, V], main *mainNode[K, V]) *mainNode[K, V] {
+	for {
+		root := m.readRoot(true)
+		prev := main.prev.Load()
+		switch {
+		case prev == nil:
+			return main
+		case prev.failed:
+			old := prev.prev.Load()
+			if in.main.CompareAndSwap(main, old) {
+				return old
+			}
+			main = in.main.Load()
+		case root.gen == in.gen && !m.readOnly:
+			if main.prev.CompareAndSwap(prev, nil) {
+				return main
+			}
+		default:
+			failed := &mainNode[K, V]{failed: true}
+			failed.prev.Store(prev)
+			main.prev.CompareAndSwap(prev, failed)
+			main = in.main.Load()
+		}
+	}
+}
+
+// copyToGen copy of I-node in of generation gen
+func (m *ConcurrentMap[K, V]) copyToGen(in *iNode[K, V], gen *generation) *iNode[K, V] {
+	return newINode(m.gcasRead(in), gen)
+}
+
+// renewed copy of C-node of generation gen, whose child I-nodes are copied to gen too
+func (m *ConcurrentMap[K, V]) renewed(cn *mainNode[K, V], gen *generation) *mainNode[K, V] {
+	branches := make([]branch[K, V], len(cn.branches))
+	for i, br := range cn.branches {
+		if br.in != nil {
+			br = branch[K, V]{in: m.copyToGen(br.in, gen)}
+		}
+		branches[i] = br
+	}
+	return &mainNode[K, V]{bitmap: cn.bitmap, branches: branches, gen: gen}
+}
+
+// renewedFor C-node itself if it's of generation gen, otherwise its renewed copy
+func (m *ConcurrentMap[K, V]) renewedFor(cn *mainNode[K, V], gen *generation) *mainNode[K, V] {
+	if cn.gen == gen {
+		return cn
+	}
+	return m.renewed(cn, gen)
+}
+
+func newINode[K, V any](main *mainNode[K, V], gen *generation) *iNode[K, V] {
+	in := &iNode[K, V]{gen: gen}
+	in.main.Store(main)
+	return in
+}
+
+// dual main node holding two leaves at shiftBits, which is a chain of C-nodes if their hashes collide
+func dual[K, V any](l1, l2 *sNode[K, V], shiftBits uint, gen *generation) *mainNode[K, V] {
+	if shiftBits >= maxHashBits {
+		return &mainNode[K, V]{bucket: []*sNode[K, V]{l1, l2}}
+	}
+	symbol1, symbol2 := l1.hash>>shiftBits&hashSymbolMask, l2.hash>>shiftBits&hashSymbolMask
+	m := bitmap(0).set(symbol1).set(symbol2)
+	if symbol1 == symbol2 {
+		sub := newINode(dual(l1, l2, shiftBits+symbolWidth, gen), gen)
+		return &mainNode[K, V]{bitmap: m, branches: []branch[K, V]{{in: sub}}, gen: gen}
+	}
+	if symbol2 < symbol1 {
+		l1, l2 = l2, l1
+	}
+	return &mainNode[K, V]{bitmap: m, branches: []branch[K, V]{{leaf: l1}, {leaf: l2}}, gen: gen}
+}
+
+// inserted copy of C-node with branch added at index for symbol
+func (cn *mainNode[K, V]) inserted(symbol uint64, index int, br branch[K, V], gen *generation) *mainNode[K, V] {
+	branches := make([]branch[K, V], len(cn.branches)+1)
+	copy(branches, cn.branches[:index])
+	branches[index] = br
+	copy(branches[index+1:], cn.branches[index:])
+	return &mainNode[K, V]{bitmap: cn.bitmap.set(symbol), branches: branches, gen: gen}
+}
+
+// updated copy of C-node with branch at index replaced
+func (cn *mainNode[K, V]) updated(index int, br branch[K, V], gen *generation) *mainNode[K, V] {
+	branches := append([]branch[K, V](nil), cn.branches...)
+	branches[index] = br
+	return &mainNode[K, V]{bitmap: cn.bitmap, branches: branches, gen: gen}
+}
+
+// removed copy of C-node without branch at index for symbol
+func (cn *mainNode[K, V]) removed(symbol uint64, index int, gen *generation) *mainNode[K, V] {
+	branches := make([]branch[K, V], 0, len(cn.branches)-1)
+	branches = append(branches, cn.branches[:index]...)
+	branches = append(branches, cn.branches[index+1:]...)
+	return &mainNode[K, V]{bitmap: cn.bitmap.clear(symbol), branches: branches, gen: gen}
+}
+
+// contracted tomb of the only leaf of C-node below root, otherwise C-node itself
+func (cn *mainNode[K, V]) contracted(shiftBits uint) *mainNode[K, V] {
+	if shiftBits > 0 && len(cn.branches) == 1 && cn.branches[0].leaf != nil {
+		return &mainNode[K, V]{tomb: cn.branches[0].leaf}
+	}
+	return cn
+}
@@ -0,0 +1,179 @@
+package hamt
+
+import (
+	"math/bits"
+	"reflect"
+)
+
+// Change key whose value differs between two maps. Old is nil for added key, New is nil for removed key,
+// and either of them is also nil for key with nil value.
+type Change[K, V any] struct {
+	Key      *K
+	Old, New *V
+}
+
+// Delta changes turning one map into another
+type Delta[K, V any] struct {
+	Added   []Change[K, V]
+	Removed []Change[K, V]
+	Changed []Change[K, V]
+}
+
+// Equal check if both maps have the same keys and values
+func Equal[K any, V comparable](a, b *Map[K, V]) bool {
+	if a == b {
+		return true
+	}
+	if a.count != b.count {
+		return false
+	}
+	return zipMaps(a, b, func(_ *K, va, vb *V, inA, inB bool) bool {
+		return inA && inB && sameValue(va, vb)
+	})
+}
+
+// Diff changes turning map a into map b
+func Diff[K any, V comparable](a, b *Map[K, V]) Delta[K, V] {
+	var d Delta[K, V]
+	if a == b {
+		return d
+	}
+	zipMaps(a, b, func(k *K, va, vb *V, inA, inB bool) bool {
+		switch {
+		case !inA:
+			d.Added = append(d.Added, Change[K, V]{Key: k, New: vb})
+		case !inB:
+			d.Removed = append(d.Removed, Change[K, V]{Key: k, Old: va})
+		case !sameValue(va, vb):
+			d.Changed = append(d.Changed, Change[K, V]{Key: k, Old: va, New: vb})
+		}
+		return true
+	})
+	return d
+}
+
+// sameValue check if values are both nil or equal
+func sameValue[V comparable](va, vb *V) bool {
+	return va == vb || va != nil && vb != nil && *va == *vb
+}
+
+// Merge create a map with keys of both maps, value of key in both is decided by resolve unless it's the same one.
+// Key is left out if resolve returns keep as false. The new map is a clone of map a (see `Map.Clone`), so it has
+// the same hasher and options as map a, and shares sub-tries with it until either of them is modified.
+// NOTE: unless the new map owns storage, caller must keep keys/values of both maps and from resolve alive.
+func Merge[K, V any](a, b *Map[K, V], resolve func(k *K, va, vb *V) (v *V, keep bool)) *Map[K, V] {
+	m := a.Clone()
+	zipMaps(a, b, func(k *K, va, vb *V, inA, inB bool) bool {
+		switch {
+		case !inA:
+			m.Add(k, vb)
+		case !inB || va == vb:
+		default:
+			v, keep := resolve(k, va, vb)
+			if !keep {
+				m.Delete(k)
+			} else if v != va {
+				m.Add(k, v)
+			}
+		}
+		return true
+	})
+	return m
+}
+
+// zipMaps call fn for each key of both maps with its values in them, and whether it's in them, until fn returns
+// false. Tries are walked together if both maps place keys the same way (see `Map.Clone`), skipping sub-tries
+// shared by them, otherwise each key of one map is looked up in the other.
+func zipMaps[K, V any](a, b *Map[K, V], fn func(k *K, va, vb *V, inA, inB bool) bool) bool {
+	if !sameLayout(a, b) {
+		return zipLookup(a, b, a.root, b.root, 0, fn)
+	}
+	return zip(a, b, a.root, b.root, 0, fn)
+}
+
+// sameLayout check if both maps have the same symbol width and hash rounds, and equal hashers.
+// Maps created by NewMap/ReadFrom have hashers of different seeds, use Clone or Hasher to get one in common.
+func sameLayout[K, V any](a, b *Map[K, V]) bool {
+	if a.width != b.width || a.maxBits != b.maxBits {
+		return false
+	}
+	ha, hb := any(a.hasher), any(b.hasher)
+	t := reflect.TypeOf(ha)
+	return t == reflect.TypeOf(hb) && t.Comparable() && ha == hb
+}
+
+// zip walk sub-tries ea of a and eb of b at shiftBits together, then call fn for each key of them.
+// AMT nodes are matched by bitmap, and the same prefix nodes by prefix, other sub-tries by lookup.
+func zip[K, V any](a, b *Map[K, V], ea, eb *entry, shiftBits uint, fn func(k *K, va, vb *V, inA, inB bool) bool) bool {
+	switch {
+	case ea == nil && eb == nil:
+		return true
+	case ea == nil:
+		return b.walk(eb, shiftBits, func(k *K, v *V) bool { return fn(k, nil, v, false, true) })
+	case eb == nil:
+		return a.walk(ea, shiftBits, func(k *K, v *V) bool { return fn(k, v, nil, true, false) })
+	case *ea == *eb:
+		// the same leaf, or sub-trie shared by both maps
+		return true
+	}
+
+	if ea.isLeaf() && eb.isLeaf() {
+		ka, kb := asKVPair[K, V](ea), asKVPair[K, V](eb)
+		if a.hasher.Equal(*ka.key, *kb.key) {
+			return fn(ka.key, ka.val, kb.val, true, true)
+		}
+		return fn(ka.key, ka.val, nil, true, false) && fn(kb.key, nil, kb.val, false, true)
+	}
+	if ea.isLeaf() || eb.isLeaf() || shiftBits >= a.maxBits {
+		return zipLookup(a, b, ea, eb, shiftBits, fn)
+	}
+
+	if ea.isPrefix() || eb.isPrefix() {
+		pa, pb := ea.asPrefixNode(), eb.asPrefixNode()
+		if !ea.isPrefix() || !eb.isPrefix() || pa.prefix != pb.prefix || pa.symbols() != pb.symbols() {
+			return zipLookup(a, b, ea, eb, shiftBits, fn)
+		}
+		return zip(a, b, pa.base().entryAt(0), pb.base().entryAt(0), shiftBits+pa.bits(a.width), fn)
+	}
+
+	na, nb := ea.asAMTNode(), eb.asAMTNode()
+	for all := uint64(na.bitmap | nb.bitmap); all != 0; all &= all - 1 {
+		symbol := uint64(bits.TrailingZeros64(all))
+		var ca, cb *entry
+		if na.contains(symbol) {
+			ca = na.base.entryAt(na.indexFor(symbol))
+		}
+		if nb.contains(symbol) {
+			cb = nb.base.entryAt(nb.indexFor(symbol))
+		}
+		if !zip(a, b, ca, cb, shiftBits+a.width, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// zipLookup call fn for each key of sub-tries ea of a and eb of b at shiftBits by looking it up in the other
+func zipLookup[K, V any](a, b *Map[K, V], ea, eb *entry, shiftBits uint, fn func(k *K, va, vb *V, inA, inB bool) bool) bool {
+	if ea != nil {
+		ok := a.walk(ea, shiftBits, func(k *K, v *V) bool {
+			c := b.seekFrom(eb, shiftBits, k, nil)
+			if !c.found {
+				return fn(k, v, nil, true, false)
+			}
+			return fn(k, v, b.kvAt(&c).val, true, true)
+		})
+		if !ok {
+			return false
+		}
+	}
+	if eb == nil {
+		return true
+	}
+	return b.walk(eb, shiftBits, func(k *K, v *V) bool {
+		if a.seekFrom(ea, shiftBits, k, nil).found {
+			return true
+		}
+		return fn(k, nil, v, false, true)
+	})
+}
@@ -9,204 +9,792 @@ import (
 )
 
 const (
+	// symbolWidth default number of hash bits consumed by each AMT level (PersistentMap always uses it)
 	symbolWidth    = 5 // bits
 	cardinality    = uint64(1) << symbolWidth
 	hashSymbolMask = cardinality - 1
 	maxHashBits    = 64
 	basePtrMask    = 1 << 63
-)
-
-const (
-	signBitMask = uint64(1) << 63
+	// prefix node is tagged by bit 62 of base pointer, with number of skipped symbols in bits 56-61.
+	// These bits are never set in user space addresses.
+	prefixTag      = 1 << 62
+	prefixLenShift = 56
+	prefixLenMask  = 0x3f
+	prefixMetaMask = prefixTag | prefixLenMask<<prefixLenShift
+	// maxHashRounds max number of hashes of a key used by map whose hasher is a Rehasher,
+	// keys colliding in all of them are put in a bucket
+	maxHashRounds = 4
+	// pathDepth initial capacity of path from root in Delete, enough for default symbol width without rehash
+	pathDepth = (maxHashBits + symbolWidth - 1) / symbolWidth
 )
 
 type Key int64
 type Value int64
 
-func (k Key) hash() uint64 {
-	return uint64(k) ^ signBitMask
-}
-
-type Map struct {
+// Map hash array mapped trie which maps pointer of key to pointer of value
+// NOTE: by default map only keeps pointers in memory invisible to GC, so caller must keep keys/values alive.
+// Use `WithOwnedStorage` to let map keep its own copies of keys/values.
+type Map[K, V any] struct {
 	count     int
 	root      *entry
+	hasher    Hasher[K]
+	rehasher  Rehasher[K]      // nil if hasher can't rehash, then keys colliding in 64 bits are put in a bucket
+	width     uint             // symbol width
+	mask      uint64           // symbol mask
+	roundBits uint             // hash bits consumed per hash round, 64 rounded up to multiple of width
+	maxBits   uint             // hash bits of all rounds, bucket is below this
+	slots     *slotStore[K, V] // nil unless map owns storage of keys/values
+	refs      refCounts        // blocks/slots shared with other generations, nil unless map is cloned
 	allocator *qfmalloc.Allocator
 	//allocator *dummyAllocator
 }
 
-func NewMap() *Map {
-	return &Map{count: 0, root: nil, allocator: nil}
+// Option configure Map on creation
+type Option func(*options)
+
+type options struct {
+	ownedStorage bool
+	symbolWidth  uint
 }
 
-func (m *Map) Count() int {
+// WithOwnedStorage make map copy keys/values into storage owned by map and visible to GC,
+// instead of keeping pointers supplied by caller.
+// Pointers returned by map are valid until the key is overwritten or deleted. Nil values are kept as nil.
+func WithOwnedStorage() Option {
+	return func(o *options) {
+		o.ownedStorage = true
+	}
+}
+
+// WithSymbolWidth set number of hash bits consumed by each AMT level, which must be 4, 5 (default) or 6.
+// Wider symbol means fewer but bigger AMT nodes, up to 64 children for 6 bits.
+func WithSymbolWidth(w uint) Option {
+	if w < 4 || w > 6 {
+		panic(fmt.Sprintf("hamt: invalid symbol width %d", w))
+	}
+	return func(o *options) {
+		o.symbolWidth = w
+	}
+}
+
+// New create an empty map using hasher h for hash and equality of keys.
+// If h is also a Rehasher, the map rehashes keys when hash bits run out instead of putting them in a bucket.
+func New[K, V any](h Hasher[K], opts ...Option) *Map[K, V] {
+	o := options{symbolWidth: symbolWidth}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	m := &Map[K, V]{count: 0, root: nil, hasher: h, allocator: nil}
+	m.width = o.symbolWidth
+	m.mask = 1<<m.width - 1
+	m.roundBits = (maxHashBits + m.width - 1) / m.width * m.width
+	m.maxBits = m.roundBits
+	if rh, ok := h.(Rehasher[K]); ok {
+		m.rehasher = rh
+		m.maxBits *= maxHashRounds
+	}
+	if o.ownedStorage {
+		m.slots = new(slotStore[K, V])
+	}
+	return m
+}
+
+// NewMap create an empty map of Key/Value hashed by KeyHasher with a random seed.
+// Use `New` with IdentityHasher to hash keys by their own bits.
+func NewMap(opts ...Option) *Map[Key, Value] {
+	return New[Key, Value](NewKeyHasher(), opts...)
+}
+
+func (m *Map[K, V]) Count() int {
 	return m.count
 }
 
-func (m *Map) Find(k *Key) *Value {
-	if m.root == nil {
+// Hasher hasher of map, pass it to `New` or `Load` to create maps placing keys the same way
+func (m *Map[K, V]) Hasher() Hasher[K] {
+	return m.hasher
+}
+
+// Clone create a new generation of map with the same hasher, options and keys/values as m in O(1).
+// Both generations share the trie, blocks of entries shared by them are copied by the first one changing them,
+// and Equal/Diff/Merge skip sub-tries they still share. Clear a generation no longer used, so that the others
+// stop copying blocks it shared with them.
+// NOTE: generations share storage (including owned keys/values), so none of them can be used while another one
+// is being modified.
+func (m *Map[K, V]) Clone() *Map[K, V] {
+	if m.root != nil {
+		if m.refs == nil {
+			m.refs = make(refCounts)
+		}
+		m.refs.add(m.rootBlock().ptr())
+	}
+	c := *m
+	return &c
+}
+
+// Clear remove all keys/values of map. Blocks of entries shared with other generations are left to them.
+func (m *Map[K, V]) Clear() {
+	if m.root != nil {
+		m.releaseBlock(m.rootBlock(), 1, 0)
+	}
+	m.root, m.count = nil, 0
+}
+
+// rootBlock block holding root entry only
+func (m *Map[K, V]) rootBlock() baseptr {
+	return toBasePtr(unsafe.Pointer(m.root))
+}
+
+func (m *Map[K, V]) Find(k *K) *V {
+	c := m.seek(k, nil)
+	if !c.found {
 		return nil
 	}
+	return m.kvAt(&c).val
+}
+
+// Add add key/val to map, replacing val of key if it exists
+func (m *Map[K, V]) Add(k *K, v *V) {
+	if m.slots != nil {
+		k, v = m.slots.own(k, v)
+	}
+
+	// path is needed by removal, or copying blocks shared with other generations
+	var stack [pathDepth]pathItem
+	var path []pathItem
+	if len(m.refs) > 0 {
+		path = stack[:0]
+	}
+	c := m.seek(k, path)
+	if c.found {
+		m.replaceAt(&c, k, v)
+		return
+	}
+	m.insertAt(&c, k, v)
+}
+
+// Delete remove key from map and return its value if exists
+func (m *Map[K, V]) Delete(k *K) (*V, bool) {
+	var stack [pathDepth]pathItem
+	c := m.seek(k, stack[:0])
+	if !c.found {
+		return nil, false
+	}
+	return m.removeAt(&c), true
+}
+
+// Compute call fn with current value of key (nil if not present), and then store the new value returned by fn,
+// or remove the key if keep is false. It returns the value of key afterward and whether key is present.
+// The trie is traversed only once. NOTE: fn must not modify map.
+func (m *Map[K, V]) Compute(k *K, fn func(old *V, present bool) (newV *V, keep bool)) (*V, bool) {
+	var stack [pathDepth]pathItem
+	c := m.seek(k, stack[:0])
+	var old *V
+	if c.found {
+		old = m.kvAt(&c).val
+	}
+
+	v, keep := fn(old, c.found)
+	if !keep {
+		if c.found {
+			m.removeAt(&c)
+		}
+		return nil, false
+	}
+	if c.found && v == old {
+		return old, true
+	}
+
+	if m.slots != nil {
+		k, v = m.slots.own(k, v)
+	}
+	if c.found {
+		m.replaceAt(&c, k, v)
+	} else {
+		m.insertAt(&c, k, v)
+	}
+	return v, true
+}
+
+// LoadOrStore return the existing value of key if present, otherwise store v.
+// The loaded result is true if value was loaded, false if stored.
+func (m *Map[K, V]) LoadOrStore(k *K, v *V) (actual *V, loaded bool) {
+	actual, _ = m.Compute(k, func(old *V, present bool) (*V, bool) {
+		loaded = present
+		if present {
+			return old, true
+		}
+		return v, true
+	})
+	return actual, loaded
+}
+
+// CompareAndSwap replace value of key with newV if its current value is oldV.
+// Values are compared by pointer, i.e. oldV should be what Find or other methods returned for key.
+func (m *Map[K, V]) CompareAndSwap(k *K, oldV, newV *V) (swapped bool) {
+	m.Compute(k, func(curr *V, present bool) (*V, bool) {
+		swapped = present && curr == oldV
+		if swapped {
+			return newV, true
+		}
+		return curr, present
+	})
+	return swapped
+}
+
+// Swap store v for key and return the previous value if any
+func (m *Map[K, V]) Swap(k *K, v *V) (previous *V, loaded bool) {
+	m.Compute(k, func(old *V, present bool) (*V, bool) {
+		if present && old != v {
+			previous = m.detachVal(old)
+		} else {
+			previous = old
+		}
+		loaded = present
+		return v, true
+	})
+	return previous, loaded
+}
+
+// cursor where seek of a key stops: its leaf or bucket if key is found, otherwise the entry where key would be
+// inserted (nil for empty map)
+type cursor struct {
+	e         *entry
+	hash      uint64 // rest of hash of key at e
+	shiftBits uint
+	index     int // index of key in bucket e, -1 if e is not a bucket or key is not in it
+	found     bool
+	path      []pathItem // AMT/prefix nodes from root to parent of e
+}
+
+// seek search key in trie, appending AMT/prefix nodes passed by to path unless path is nil
+func (m *Map[K, V]) seek(k *K, path []pathItem) cursor {
+	return m.seekFrom(m.root, 0, k, path)
+}
+
+// seekFrom search key in sub-trie curr at shiftBits like seek
+func (m *Map[K, V]) seekFrom(curr *entry, shiftBits uint, k *K, path []pathItem) cursor {
+	c := cursor{e: curr, index: -1, path: path}
+	if curr == nil {
+		return c
+	}
 
-	curr := m.root
-	hash := k.hash()
-	shiftBits := uint(0)
+	// hash is not used by bucket, which is all that's left if hash runs out
+	hash := m.hashAt(k, shiftBits)
 	for {
+		c.e, c.hash, c.shiftBits = curr, hash, shiftBits
 		if curr.isLeaf() {
-			kv := curr.asKVPair()
-			if *(kv.key) == *k {
-				return kv.val
-			}
-			return nil
+			c.found = m.hasher.Equal(*asKVPair[K, V](curr).key, *k)
+			return c
 		}
 
-		if shiftBits >= maxHashBits {
-			bucket := curr.asKVBucket()
-			kv := bucket.find(k)
-			if kv == nil {
-				return nil
+		// curr must be bucket if hash runs out
+		if shiftBits >= m.maxBits {
+			c.index = m.bucketIndexOf(curr.asKVBucket(), k)
+			c.found = c.index >= 0
+			return c
+		}
+
+		if curr.isPrefix() {
+			p := curr.asPrefixNode()
+			if p.match(hash, m.width) < p.symbols() {
+				return c
 			}
-			return kv.val
+			if path != nil {
+				c.path = append(c.path, pathItem{e: curr, shiftBits: shiftBits})
+			}
+			curr = p.base().entryAt(0)
+			hash, shiftBits = m.advance(k, hash, shiftBits, p.bits(m.width))
+			continue
 		}
 
+		// curr is an intermediate AMT node
 		amt := curr.asAMTNode()
-		symbol := hash & hashSymbolMask
+		symbol := hash & m.mask
 		if !amt.contains(symbol) {
-			return nil
+			return c
+		}
+		if path != nil {
+			c.path = append(c.path, pathItem{e: curr, symbol: symbol, shiftBits: shiftBits})
 		}
 		curr = amt.base.entryAt(amt.indexFor(symbol))
-		shiftBits += symbolWidth
-		hash >>= symbolWidth
+		hash, shiftBits = m.advance(k, hash, shiftBits, m.width)
 	}
 }
 
-func (m *Map) Add(k *Key, v *Value) {
-	if m.root == nil {
-		m.allocator = qfmalloc.New(entrySize, int(cardinality))
-		//m.allocator = &dummyAllocator{}
+// kvAt key/val pair of key found by seek
+func (m *Map[K, V]) kvAt(c *cursor) *kvPair[K, V] {
+	if c.index >= 0 {
+		return asKVPair[K, V](c.e.asKVBucket().base.entryAt(c.index))
+	}
+	return asKVPair[K, V](c.e)
+}
+
+// insertAt insert key/val not found by seek
+func (m *Map[K, V]) insertAt(c *cursor, k *K, v *V) {
+	m.count++
+	if c.e == nil {
+		if m.allocator == nil {
+			m.allocator = qfmalloc.New(entrySize, 1<<m.width)
+			//m.allocator = &dummyAllocator{}
+		}
 		base := toBasePtr(m.allocator.Alloc(1))
-		base.entryAt(0).asKVPair().set(k, v)
+		asKVPair[K, V](base.entryAt(0)).set(k, v)
 		m.root = base.entryAt(0)
-		m.count++
 		return
 	}
 
-	curr := m.root
-	hash := k.hash()
-	shiftBits := uint(0)
-	for {
-		if curr.isLeaf() {
-			old := curr.asKVPair()
-			oldK, oldV := old.key, old.val
+	m.unshare(c)
+	curr, hash, shiftBits := c.e, c.hash, c.shiftBits
+	if curr.isLeaf() {
+		old := asKVPair[K, V](curr)
+		oldK, oldV := old.key, old.val
+
+		// leaf below the last AMT level collides in all hash bits
+		if shiftBits >= m.maxBits {
+			m.to2KVBucket(curr, oldK, k, oldV, v)
+			return
+		}
 
-			// replace val if key already exists
-			if *(oldK) == *k {
-				old.setVal(v)
+		// symbols shared by both hashes are skipped by a prefix node per hash round
+		oldHash := m.hashAt(oldK, shiftBits)
+		for shiftBits < m.maxBits {
+			n := m.commonSymbols(hash, oldHash, shiftBits)
+			if n > 0 {
+				curr = m.extendPrefix(curr, hash, n)
+				nbits := uint(n) * m.width
+				oldHash, _ = m.advance(oldK, oldHash, shiftBits, nbits)
+				hash, shiftBits = m.advance(k, hash, shiftBits, nbits)
+			}
+			if shiftBits < m.maxBits && hash&m.mask != oldHash&m.mask {
+				m.to2KVAMT(curr, oldHash&m.mask, hash&m.mask, oldK, k, oldV, v)
 				return
 			}
+		}
+		m.to2KVBucket(curr, oldK, k, oldV, v)
+		return
+	}
 
-			m.count++
-
-			oldHash := oldK.hash() >> shiftBits
-			for {
-				if shiftBits >= maxHashBits {
-					m.to2KVBucket(curr, oldK, k, oldV, v)
-					return
-				}
-
-				newSymbol := hash & hashSymbolMask
-				oldSymbol := oldHash & hashSymbolMask
-
-				// no collision
-				if newSymbol != oldSymbol {
-					m.to2KVAMT(curr, oldSymbol, newSymbol, oldK, k, oldV, v)
-					return
-				}
-
-				// collision happen
-				curr = m.extendAMTChain(curr.asAMTNode(), newSymbol)
-				shiftBits += symbolWidth
-				hash >>= symbolWidth
-				oldHash >>= symbolWidth
-			}
+	if shiftBits >= m.maxBits {
+		m.bucketAppendKV(curr.asKVBucket(), k, v)
+		return
+	}
+
+	if curr.isPrefix() {
+		m.splitPrefix(curr, curr.asPrefixNode().match(hash, m.width), hash, k, v)
+		return
+	}
+
+	amt := curr.asAMTNode()
+	symbol := hash & m.mask
+	m.amtAddKV(amt, symbol, amt.indexFor(symbol), k, v)
+}
+
+// removeAt remove key/val found by seek and return its value
+func (m *Map[K, V]) removeAt(c *cursor) *V {
+	m.unshare(c)
+	m.count--
+	if c.index >= 0 {
+		v := m.releaseKV(m.kvAt(c))
+		m.bucketRemoveKV(c.e, c.index)
+		m.collapseAMTChain(c.path)
+		return v
+	}
+	v := m.releaseKV(asKVPair[K, V](c.e))
+	m.removeChild(c.path)
+	return v
+}
+
+// replaceAt replace key/val found by seek
+func (m *Map[K, V]) replaceAt(c *cursor, k *K, v *V) {
+	m.unshare(c)
+	m.replaceKV(m.kvAt(c), k, v)
+}
+
+// unshare copy blocks shared with other generations from root down to the entry of cursor, and the block of its
+// children if it's not a leaf, so that they can be modified in place. Cursor is moved to the copies.
+// Path must be tracked by seek if map has blocks shared.
+func (m *Map[K, V]) unshare(c *cursor) {
+	if len(m.refs) == 0 || c.e == nil {
+		return
+	}
+
+	m.root = m.ownBlock(m.rootBlock(), 1, 0).entryAt(0)
+	e := m.root
+	for i := range c.path {
+		next := c.e
+		if i+1 < len(c.path) {
+			next = c.path[i+1].e
 		}
+		c.path[i].e = e
+		e = m.ownChildren(e, c.path[i].shiftBits, next)
+	}
+	c.e = e
+	if !e.isLeaf() {
+		m.ownChildren(e, c.shiftBits, nil)
+	}
+}
 
-		// curr must be bucket if hash runs out
-		if shiftBits >= maxHashBits {
-			bucket := curr.asKVBucket()
-			old := bucket.find(k)
-			if old == nil {
-				m.count++
-				m.bucketAppendKV(curr.asKVBucket(), k, v)
-			} else {
-				old.val = v
-			}
+// ownChildren make block of children of node e at shiftBits owned by map, and return where child is in it
+func (m *Map[K, V]) ownChildren(e *entry, shiftBits uint, child *entry) *entry {
+	base, n, childShiftBits := m.children(e, shiftBits)
+	owned := m.ownBlock(base, n, childShiftBits)
+	if owned != base {
+		m.setChildren(e, shiftBits, owned)
+	}
+	if child == nil {
+		return nil
+	}
+	return owned.entryAt(int((uintptr(unsafe.Pointer(child)) - uintptr(base.ptr())) / entrySize))
+}
+
+// ownBlock return block of n entries at shiftBits if it's not shared with other generations, otherwise a copy of
+// it, whose children are then shared by one more block
+func (m *Map[K, V]) ownBlock(base baseptr, n int, shiftBits uint) baseptr {
+	if !m.refs.shared(base.ptr()) {
+		return base
+	}
+	m.refs.drop(base.ptr())
+	owned := toBasePtr(m.allocator.Alloc(n))
+	copyEntryList(owned, base, 0, 0, n)
+	for i := 0; i < n; i++ {
+		e := owned.entryAt(i)
+		if !e.isLeaf() {
+			children, _, _ := m.children(e, shiftBits)
+			m.refs.add(children.ptr())
+		} else if m.slots != nil {
+			m.refs.add(unsafe.Pointer(slotOf[K, V](asKVPair[K, V](e).key)))
+		}
+	}
+	return owned
+}
+
+// releaseBlock drop a reference to block of n entries at shiftBits, and free it along with sub-tries of its entries
+// unless it's shared with other generations
+func (m *Map[K, V]) releaseBlock(base baseptr, n int, shiftBits uint) {
+	if m.refs.shared(base.ptr()) {
+		m.refs.drop(base.ptr())
+		return
+	}
+	for i := 0; i < n; i++ {
+		e := base.entryAt(i)
+		if !e.isLeaf() {
+			m.releaseBlock(m.children(e, shiftBits))
+		} else if m.slots != nil {
+			m.releaseSlot(asKVPair[K, V](e).key)
+		}
+	}
+	m.allocator.Free(base.ptr())
+}
+
+// children block of children of node e at shiftBits, number of entries in it and their shift bits
+func (m *Map[K, V]) children(e *entry, shiftBits uint) (baseptr, int, uint) {
+	switch {
+	case shiftBits >= m.maxBits:
+		b := e.asKVBucket()
+		return b.base, int(b.count), shiftBits
+	case e.isPrefix():
+		p := e.asPrefixNode()
+		return p.base(), 1, shiftBits + p.bits(m.width)
+	default:
+		n := e.asAMTNode()
+		return n.base, n.childNum(), shiftBits + m.width
+	}
+}
+
+// setChildren replace block of children of node e at shiftBits
+func (m *Map[K, V]) setChildren(e *entry, shiftBits uint, base baseptr) {
+	switch {
+	case shiftBits >= m.maxBits:
+		b := e.asKVBucket()
+		b.set(b.count, base)
+	case e.isPrefix():
+		p := e.asPrefixNode()
+		p.set(p.prefix, p.symbols(), base, m.width)
+	default:
+		n := e.asAMTNode()
+		n.set(n.bitmap, base)
+	}
+}
+
+// hashAt hash of key k shifted by shiftBits, computed by hash round which shiftBits falls in.
+// It's 0 if hash of all rounds is used up.
+func (m *Map[K, V]) hashAt(k *K, shiftBits uint) uint64 {
+	if shiftBits >= m.maxBits {
+		return 0
+	}
+	round := shiftBits / m.roundBits
+	if round == 0 {
+		return m.hasher.Hash(*k) >> shiftBits
+	}
+	return m.rehasher.Rehash(*k, int(round)) >> (shiftBits % m.roundBits)
+}
+
+// advance consume n bits of hash of key k at shiftBits, and return the rest of hash and new shiftBits.
+// Hash of next round is computed when the current one is used up.
+func (m *Map[K, V]) advance(k *K, hash uint64, shiftBits, n uint) (uint64, uint) {
+	shiftBits += n
+	if shiftBits%m.roundBits != 0 {
+		return hash >> n, shiftBits
+	}
+	if shiftBits >= m.maxBits {
+		return 0, shiftBits
+	}
+	return m.rehasher.Rehash(*k, int(shiftBits/m.roundBits)), shiftBits
+}
+
+// pathItem an AMT or prefix node on the path from root, its shift bits,
+// and the symbol taken to its child (AMT node only)
+type pathItem struct {
+	e         *entry
+	symbol    uint64
+	shiftBits uint
+}
+
+// removeChild remove the child taken by the last item of path. AMT/prefix nodes emptied by the removal are
+// removed from their parents too, and the root is released if the whole map becomes empty.
+func (m *Map[K, V]) removeChild(path []pathItem) {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].e.isPrefix() {
+			m.allocator.Free(path[i].e.asPrefixNode().base().ptr())
+			continue
+		}
+		amt := path[i].e.asAMTNode()
+		if amt.childNum() > 1 {
+			m.amtRemoveKV(amt, path[i].symbol, amt.indexFor(path[i].symbol))
+			m.collapseAMTChain(path[:i+1])
 			return
 		}
+		// the only child is gone, so is the AMT node itself
+		m.allocator.Free(amt.base.ptr())
+	}
 
-		// curr is an intermediate AMT node
-		amt := curr.asAMTNode()
-		symbol := hash & hashSymbolMask
-		index := amt.indexFor(symbol)
-		if !amt.contains(symbol) {
-			m.count++
-			m.amtAddKV(amt, symbol, index, k, v)
+	m.allocator.Free(unsafe.Pointer(m.root))
+	m.root = nil
+}
+
+// collapseAMTChain pull a lonely leaf up along single-child AMT/prefix chain ending at the last item of path.
+// A single-child AMT node left with a non-leaf child is compressed into a prefix node.
+func (m *Map[K, V]) collapseAMTChain(path []pathItem) {
+	for i := len(path) - 1; i >= 0; i-- {
+		e := path[i].e
+		var base baseptr
+		if e.isPrefix() {
+			base = e.asPrefixNode().base()
+		} else {
+			amt := e.asAMTNode()
+			if amt.childNum() != 1 {
+				return
+			}
+			base = amt.base
+		}
+
+		child := base.entryAt(0)
+		if !child.isLeaf() {
+			if !e.isPrefix() {
+				m.compressAMT(path[:i+1])
+			}
 			return
 		}
-		curr = amt.base.entryAt(index)
-		shiftBits += symbolWidth
-		hash >>= symbolWidth
+		e.copyFrom(child)
+		m.allocator.Free(base.ptr())
+	}
+}
+
+// compressAMT convert single-child AMT node, the last item of path, into a prefix node,
+// which is merged with its child and parent if they are prefix nodes of the same hash round
+func (m *Map[K, V]) compressAMT(path []pathItem) {
+	item := path[len(path)-1]
+	e := item.e
+	amt := e.asAMTNode()
+	base := amt.base
+	prefix, symbols := uint64(bits.TrailingZeros64(uint64(amt.bitmap))), 1
+
+	if child := base.entryAt(0); child.isPrefix() && (item.shiftBits+m.width)%m.roundBits != 0 {
+		// child lives in the block being freed, so read it first
+		cp := child.asPrefixNode()
+		prefix |= cp.prefix << m.width
+		symbols += cp.symbols()
+		childBase := cp.base()
+		m.allocator.Free(base.ptr())
+		base = childBase
+	}
+	if len(path) > 1 && path[len(path)-2].e.isPrefix() && item.shiftBits%m.roundBits != 0 {
+		parent := path[len(path)-2].e
+		pp := parent.asPrefixNode()
+		prefix = pp.prefix | prefix<<pp.bits(m.width)
+		symbols += pp.symbols()
+		m.allocator.Free(pp.base().ptr())
+		e = parent
+	}
+	e.asPrefixNode().set(prefix, symbols, base, m.width)
+}
+
+// replaceKV replace value of existing key/val pair
+func (m *Map[K, V]) replaceKV(kv *kvPair[K, V], k *K, v *V) {
+	if m.slots != nil {
+		m.releaseSlot(kv.key)
+		kv.set(k, v)
+		return
+	}
+	kv.setVal(v)
+}
+
+// releaseKV release storage of key/val pair to be removed and return its value
+func (m *Map[K, V]) releaseKV(kv *kvPair[K, V]) *V {
+	v := m.detachVal(kv.val)
+	if m.slots != nil {
+		m.releaseSlot(kv.key)
+	}
+	return v
+}
+
+// releaseSlot release slot of key unless it's shared with other generations
+func (m *Map[K, V]) releaseSlot(k *K) {
+	sl := slotOf[K, V](k)
+	if m.refs.shared(unsafe.Pointer(sl)) {
+		m.refs.drop(unsafe.Pointer(sl))
+		return
+	}
+	m.slots.release(sl)
+}
+
+// detachVal copy value of key/val pair which storage is about to be released by map,
+// or return v itself if map doesn't own storage or v is nil
+func (m *Map[K, V]) detachVal(v *V) *V {
+	if m.slots == nil || v == nil {
+		return v
 	}
+	c := new(V)
+	*c = *v
+	return c
 }
 
-func (m *Map) extendAMTChain(n *amtNode, symbol uint64) *entry {
+// extendPrefix convert entry to prefix node skipping the first n symbols of hash, and return its child
+func (m *Map[K, V]) extendPrefix(e *entry, hash uint64, n int) *entry {
 	base := toBasePtr(m.allocator.Alloc(1))
-	n.set(bitmap(0).set(symbol), base)
+	e.asPrefixNode().set(hash, n, base, m.width)
 	return base.entryAt(0)
 }
 
-func (m *Map) to2KVAMT(leaf *entry, symbol1, symbol2 uint64, k1, k2 *Key, v1, v2 *Value) {
+// splitPrefix split prefix node whose first n symbols match hash into (optional) prefix node of the n symbols,
+// then an AMT node holding new key/val and the rest of old prefix node
+func (m *Map[K, V]) splitPrefix(e *entry, n int, hash uint64, k *K, v *V) {
+	p := e.asPrefixNode()
+	prefix, symbols, base := p.prefix, p.symbols(), p.base()
+	shift := uint(n) * m.width
+	oldSymbol := (prefix >> shift) & m.mask
+	newSymbol := (hash >> shift) & m.mask
+
+	amtEntry := e
+	if n > 0 {
+		amtEntry = m.extendPrefix(e, prefix, n)
+	}
+
+	amtBase := toBasePtr(m.allocator.Alloc(2))
+	oldIndex, newIndex := 0, 1
+	if newSymbol < oldSymbol {
+		oldIndex, newIndex = 1, 0
+	}
+	rest := amtBase.entryAt(oldIndex)
+	if restSymbols := symbols - n - 1; restSymbols > 0 {
+		rest.asPrefixNode().set(prefix>>(shift+m.width), restSymbols, base, m.width)
+	} else {
+		rest.copyFrom(base.entryAt(0))
+		m.allocator.Free(base.ptr())
+	}
+	asKVPair[K, V](amtBase.entryAt(newIndex)).set(k, v)
+	amtEntry.asAMTNode().set(bitmap(0).set(oldSymbol).set(newSymbol), amtBase)
+}
+
+// commonSymbols number of symbols shared by both hashes from shiftBits, up to the end of current hash round
+func (m *Map[K, V]) commonSymbols(hash1, hash2 uint64, shiftBits uint) int {
+	remaining := int((m.roundBits - shiftBits%m.roundBits) / m.width)
+	return min(commonLowSymbols(hash1, hash2, m.width), remaining)
+}
+
+// commonLowSymbols number of lowest w-bit symbols shared by both hashes, all symbols (including a partial
+// one at the top) if they are equal
+func commonLowSymbols(hash1, hash2 uint64, w uint) int {
+	diff := hash1 ^ hash2
+	if diff == 0 {
+		return maxHashBits
+	}
+	return bits.TrailingZeros64(diff) / int(w)
+}
+
+func (m *Map[K, V]) to2KVAMT(leaf *entry, symbol1, symbol2 uint64, k1, k2 *K, v1, v2 *V) {
 	base := toBasePtr(m.allocator.Alloc(2))
 	amt := leaf.asAMTNode()
 	amt.set(bitmap(0).set(symbol1).set(symbol2), base)
 	if symbol1 < symbol2 {
-		base.entryAt(0).asKVPair().set(k1, v1)
-		base.entryAt(1).asKVPair().set(k2, v2)
+		asKVPair[K, V](base.entryAt(0)).set(k1, v1)
+		asKVPair[K, V](base.entryAt(1)).set(k2, v2)
 	} else {
-		base.entryAt(0).asKVPair().set(k2, v2)
-		base.entryAt(1).asKVPair().set(k1, v1)
+		asKVPair[K, V](base.entryAt(0)).set(k2, v2)
+		asKVPair[K, V](base.entryAt(1)).set(k1, v1)
 	}
 }
 
 // chainBucketWith2KV convert entry to a kvBucket and append new key/val to bucket
-func (m *Map) to2KVBucket(e *entry, k1, k2 *Key, v1, v2 *Value) {
+func (m *Map[K, V]) to2KVBucket(e *entry, k1, k2 *K, v1, v2 *V) {
 	base := toBasePtr(m.allocator.Alloc(2))
-	base.entryAt(0).asKVPair().set(k1, v1)
-	base.entryAt(1).asKVPair().set(k2, v2)
+	asKVPair[K, V](base.entryAt(0)).set(k1, v1)
+	asKVPair[K, V](base.entryAt(1)).set(k2, v2)
 	e.asKVBucket().set(2, base)
 }
 
 // bucketAppendKV reallocate bigger bucket to make room for new key/val
-func (m *Map) bucketAppendKV(b *kvBucket, k *Key, v *Value) {
+func (m *Map[K, V]) bucketAppendKV(b *kvBucket, k *K, v *V) {
 	oldBase := b.base
 	newBase := toBasePtr(m.allocator.Alloc(int(b.count + 1)))
 	copyEntryList(newBase, oldBase, 0, 0, int(b.count))
-	newBase.entryAt(int(b.count)).asKVPair().set(k, v)
+	asKVPair[K, V](newBase.entryAt(int(b.count))).set(k, v)
 	b.set(b.count+1, newBase)
 	m.allocator.Free(oldBase.ptr())
 }
 
 // amtAddKV reallocate bigger sub-trie to make room for new k/v pair
-func (m *Map) amtAddKV(n *amtNode, symbol uint64, index int, k *Key, v *Value) {
+func (m *Map[K, V]) amtAddKV(n *amtNode, symbol uint64, index int, k *K, v *V) {
 	oldBase := n.base
 	newChildNum := n.childNum() + 1
 	newBase := toBasePtr(m.allocator.Alloc(newChildNum))
 	copyEntryList(newBase, oldBase, 0, 0, index)
-	newBase.entryAt(index).asKVPair().set(k, v)
+	asKVPair[K, V](newBase.entryAt(index)).set(k, v)
 	copyEntryList(newBase, oldBase, index+1, index, newChildNum-index-1)
 	n.set(n.bitmap.set(symbol), newBase)
 	m.allocator.Free(oldBase.ptr())
 }
 
+// amtRemoveKV reallocate smaller sub-trie without the child at index
+func (m *Map[K, V]) amtRemoveKV(n *amtNode, symbol uint64, index int) {
+	oldBase := n.base
+	newChildNum := n.childNum() - 1
+	newBase := toBasePtr(m.allocator.Alloc(newChildNum))
+	copyEntryList(newBase, oldBase, 0, 0, index)
+	copyEntryList(newBase, oldBase, index, index+1, newChildNum-index)
+	n.set(n.bitmap.clear(symbol), newBase)
+	m.allocator.Free(oldBase.ptr())
+}
+
+// bucketRemoveKV reallocate smaller bucket without the key/val at index,
+// bucket with only one key/val left is converted to a leaf
+func (m *Map[K, V]) bucketRemoveKV(e *entry, index int) {
+	b := e.asKVBucket()
+	oldBase := b.base
+	if b.count == 2 {
+		e.copyFrom(oldBase.entryAt(1 - index))
+		m.allocator.Free(oldBase.ptr())
+		return
+	}
+	newCount := int(b.count - 1)
+	newBase := toBasePtr(m.allocator.Alloc(newCount))
+	copyEntryList(newBase, oldBase, 0, 0, index)
+	copyEntryList(newBase, oldBase, index, index+1, newCount-index)
+	b.set(int64(newCount), newBase)
+	m.allocator.Free(oldBase.ptr())
+}
+
 func copyEntryList(dstBase, srcBase baseptr, dstStartIdx, srcStartIdx int, count int) {
 	for i := 0; i < count; i++ {
 		dst := dstBase.entryAt(dstStartIdx + i)
@@ -215,9 +803,10 @@ func copyEntryList(dstBase, srcBase baseptr, dstStartIdx, srcStartIdx int, count
 	}
 }
 
-// entry is a union type of `amtNode` and `kvPair` and `kvBucket`
-// NOTE: type information is lost at runtime so we need some metadata to distinguish objects of the 3 types.
+// entry is a union type of `amtNode` and `prefixNode` and `kvPair` and `kvBucket`
+// NOTE: type information is lost at runtime so we need some metadata to distinguish objects of the 4 types.
 // `amtNode` is identified by setting most-significant-bit of `baseValPairs`.
+// `prefixNode` is an `amtNode` further tagged by `prefixTag`.
 // `kvBucket` can be identified by shift bits.
 type entry struct {
 	// mapKeyCnt stores `amtNode.bitmap` or `kvPair.key` or `kvBucket.count`
@@ -258,10 +847,45 @@ type amtNode struct {
 	base baseptr
 }
 
+// prefixNode path-compressed chain of single-child AMT nodes, which skips symbols of hash shared by all keys
+// below it. Its only child is an AMT node or a bucket.
+type prefixNode struct {
+	// skipped symbols, the first one at the lowest bits
+	prefix uint64
+	// base pointer of child tagged with `prefixTag` and number of skipped symbols
+	meta uint64
+}
+
+func (p *prefixNode) set(prefix uint64, symbols int, base baseptr, w uint) {
+	if n := uint(symbols) * w; n < maxHashBits {
+		prefix &= 1<<n - 1
+	}
+	p.prefix = prefix
+	p.meta = uint64(base) | prefixTag | uint64(symbols)<<prefixLenShift
+}
+
+func (p *prefixNode) symbols() int {
+	return int(p.meta >> prefixLenShift & prefixLenMask)
+}
+
+// bits number of skipped hash bits of w-bit symbols
+func (p *prefixNode) bits(w uint) uint {
+	return uint(p.symbols()) * w
+}
+
+func (p *prefixNode) base() baseptr {
+	return baseptr(p.meta &^ prefixMetaMask)
+}
+
+// match number of leading w-bit symbols of hash matching prefix
+func (p *prefixNode) match(hash uint64, w uint) int {
+	return min(commonLowSymbols(hash, p.prefix, w), p.symbols())
+}
+
 // kvPair key/value pair
-type kvPair struct {
-	key *Key
-	val *Value
+type kvPair[K, V any] struct {
+	key *K
+	val *V
 }
 
 // kvBucket store multi key/value pairs with conflict hash
@@ -270,6 +894,27 @@ type kvBucket struct {
 	base  baseptr // base pointer to kv-pair list  (with most-significant-bit as 1)
 }
 
+// refCounts extra references to blocks of entries and slots shared by generations of map (see `Map.Clone`),
+// keyed by their addresses. Those not in it are referenced only once.
+type refCounts map[unsafe.Pointer]int
+
+func (r refCounts) shared(p unsafe.Pointer) bool {
+	return r[p] > 0
+}
+
+func (r refCounts) add(p unsafe.Pointer) {
+	r[p]++
+}
+
+// drop remove a reference to shared p
+func (r refCounts) drop(p unsafe.Pointer) {
+	if r[p] > 1 {
+		r[p]--
+		return
+	}
+	delete(r, p)
+}
+
 type bitmap uint64
 
 func (m bitmap) countBelow(symbol uint64) int {
@@ -284,6 +929,10 @@ func (m bitmap) set(symbol uint64) bitmap {
 	return bitmap(uint64(m) | (1 << symbol))
 }
 
+func (m bitmap) clear(symbol uint64) bitmap {
+	return bitmap(uint64(m) &^ (1 << symbol))
+}
+
 func (m bitmap) reset() bitmap {
 	return bitmap(0)
 }
@@ -293,9 +942,9 @@ func (e *entry) asAMTNode() *amtNode {
 	return (*amtNode)(unsafe.Pointer(e))
 }
 
-// kvPair cast entry to kvPair
-func (e *entry) asKVPair() *kvPair {
-	return (*kvPair)(unsafe.Pointer(e))
+// asKVPair cast entry to kvPair
+func asKVPair[K, V any](e *entry) *kvPair[K, V] {
+	return (*kvPair[K, V])(unsafe.Pointer(e))
 }
 
 func (e *entry) copyFrom(e2 *entry) {
@@ -303,6 +952,17 @@ func (e *entry) copyFrom(e2 *entry) {
 	e.baseVal = e2.baseVal
 }
 
+// asPrefixNode cast entry to prefixNode
+func (e *entry) asPrefixNode() *prefixNode {
+	return (*prefixNode)(unsafe.Pointer(e))
+}
+
+// isPrefix check if underlying type of entry is prefix node.
+// Tag bit is never set in value pointer of leaf or base pointer of bucket.
+func (e *entry) isPrefix() bool {
+	return e.baseVal&prefixTag != 0
+}
+
 // kvBucket cast entry to kvBucket
 func (e *entry) asKVBucket() *kvBucket {
 	return (*kvBucket)(unsafe.Pointer(e))
@@ -319,7 +979,7 @@ func (n *amtNode) set(m bitmap, base baseptr) {
 }
 
 func (n *amtNode) childNum() int {
-	return n.bitmap.countBelow(cardinality)
+	return bits.OnesCount64(uint64(n.bitmap))
 }
 
 func (n *amtNode) indexFor(symbol uint64) int {
@@ -330,12 +990,12 @@ func (n *amtNode) contains(symbol uint64) bool {
 	return n.bitmap.isSet(symbol)
 }
 
-func (kv *kvPair) set(k *Key, v *Value) {
+func (kv *kvPair[K, V]) set(k *K, v *V) {
 	kv.key = k
 	kv.val = v
 }
 
-func (kv *kvPair) setVal(v *Value) {
+func (kv *kvPair[K, V]) setVal(v *V) {
 	kv.val = v
 }
 
@@ -344,25 +1004,25 @@ func (b *kvBucket) set(count int64, base baseptr) {
 	b.base = base
 }
 
-// find linear search key in bucket
-func (b *kvBucket) find(k *Key) *kvPair {
+// bucketIndexOf linear search key in bucket and return its index or -1 if not found
+func (m *Map[K, V]) bucketIndexOf(b *kvBucket, k *K) int {
 	base := b.base
 	cnt := int(b.count)
 	for i := 0; i < cnt; i++ {
-		kv := base.entryAt(i).asKVPair()
-		if *kv.key == *k {
-			return kv
+		if m.hasher.Equal(*asKVPair[K, V](base.entryAt(i)).key, *k) {
+			return i
 		}
 	}
-	return nil
+	return -1
 }
 
 type debugItem struct {
-	e     *entry
-	depth int
+	e         *entry
+	depth     int
+	shiftBits uint
 }
 
-func debugMap(m *Map) string {
+func debugMap[K, V any](m *Map[K, V]) string {
 	if m.root == nil {
 		return "<nil>"
 	}
@@ -370,7 +1030,7 @@ func debugMap(m *Map) string {
 	prevDepth := -1
 	queue := []debugItem{{e: m.root, depth: 0}}
 	for len(queue) > 0 {
-		top, depth := queue[0].e, queue[0].depth
+		top, depth, shiftBits := queue[0].e, queue[0].depth, queue[0].shiftBits
 		queue = queue[1:]
 
 		if prevDepth != depth {
@@ -379,21 +1039,25 @@ func debugMap(m *Map) string {
 		prevDepth = depth
 
 		if top.isLeaf() {
-			kv := top.asKVPair()
+			kv := asKVPair[K, V](top)
 			out += fmt.Sprintf(" <leaf(%p):%p|%p>", kv, kv.key, kv.val)
-		} else if depth*symbolWidth >= maxHashBits {
+		} else if shiftBits >= m.maxBits {
 			b := top.asKVBucket()
 			out += fmt.Sprintf(" <bucket(%p):%d|%p>", b, b.count, b.base.ptr())
 			for i := 0; i < int(b.count); i++ {
 				child := b.base.entryAt(i)
-				queue = append(queue, debugItem{e: child, depth: depth + 1})
+				queue = append(queue, debugItem{e: child, depth: depth + 1, shiftBits: shiftBits})
 			}
+		} else if top.isPrefix() {
+			p := top.asPrefixNode()
+			out += fmt.Sprintf(" <prefix(%p):%d:%#x|%p>", p, p.symbols(), p.prefix, p.base().ptr())
+			queue = append(queue, debugItem{e: p.base().entryAt(0), depth: depth + 1, shiftBits: shiftBits + p.bits(m.width)})
 		} else {
 			n := top.asAMTNode()
 			out += fmt.Sprintf(" <amt(%p):%d|%p>", n, n.childNum(), n.base.ptr())
 			for i := 0; i < n.childNum(); i++ {
 				child := n.base.entryAt(i)
-				queue = append(queue, debugItem{e: child, depth: depth + 1})
+				queue = append(queue, debugItem{e: child, depth: depth + 1, shiftBits: shiftBits + m.width})
 			}
 		}
 	}
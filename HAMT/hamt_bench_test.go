@@ -1,30 +1,12 @@
 package hamt
 
 import (
-	"math/rand"
 	"testing"
 
 	gart "github.com/plar/go-adaptive-radix-tree"
 )
 
-func genTestKVs(n int, max int64) ([]Key, []Value) {
-	keys := []Key{}
-	vals := []Value{}
-	keyMap := make(map[Key]bool)
-
-	for len(keys) < n {
-		k := Key(rand.Int63n(max))
-		if !keyMap[k] {
-			keyMap[k] = true
-			keys = append(keys, k)
-			vals = append(vals, Value(len(keys)))
-		}
-	}
-
-	return keys, vals
-}
-
-func makeHAMT(keys []Key, vals []Value) *Map {
+func makeHAMT(keys []Key, vals []Value) *Map[Key, Value] {
 	m := NewMap()
 	for i := 0; i < len(keys); i++ {
 		m.Add(&keys[i], &vals[i])
@@ -1,7 +1,14 @@
 package hamt
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"math/rand"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -50,3 +57,1102 @@ func TestNewMap(t *testing.T) {
 		assert.Equal(t, &vals[i], v, "key=%d val=%d", keys[i], vals[i])
 	}
 }
+
+func TestMap_Delete(t *testing.T) {
+	m := NewMap()
+
+	keys := []Key{}
+	vals := []Value{}
+	keyMap := make(map[Key]bool)
+
+	for len(keys) < 100000 {
+		k := Key(rand.Uint64())
+		if !keyMap[k] {
+			keyMap[k] = true
+			keys = append(keys, k)
+			vals = append(vals, Value(len(keys)))
+		}
+	}
+
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+
+	for i := 0; i < len(keys); i += 2 {
+		v, ok := m.Delete(&keys[i])
+		assert.True(t, ok)
+		assert.Equal(t, &vals[i], v, "key=%d val=%d", keys[i], vals[i])
+	}
+	assert.Equal(t, len(keys)/2, m.Count())
+
+	for i := 0; i < len(keys); i++ {
+		v := m.Find(&keys[i])
+		if i%2 == 0 {
+			assert.Nil(t, v, "key=%d", keys[i])
+		} else {
+			assert.Equal(t, &vals[i], v, "key=%d val=%d", keys[i], vals[i])
+		}
+	}
+
+	for i := 1; i < len(keys); i += 2 {
+		_, ok := m.Delete(&keys[i])
+		assert.True(t, ok)
+		_, ok = m.Delete(&keys[i])
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 0, m.Count())
+	assert.Nil(t, m.root)
+	assert.Equal(t, uintptr(0), m.allocator.Stats().InUseBytes)
+}
+
+func TestMap_DeleteCollapse(t *testing.T) {
+	m := New[Key, Value](IdentityHasher{})
+
+	// keys share the first 12 symbols of hash
+	keys := []Key{0, 1 << 60, 2 << 60}
+	vals := []Value{1, 2, 3}
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+
+	m.Delete(&keys[1])
+	assert.False(t, m.root.isLeaf())
+	m.Delete(&keys[2])
+	assert.True(t, m.root.isLeaf(), debugMap(m))
+	assert.Equal(t, &vals[0], m.Find(&keys[0]))
+	assert.Equal(t, 1, m.Count())
+}
+
+func TestKeyHasher(t *testing.T) {
+	h := NewKeyHasher()
+	assert.NotEqual(t, h.Hash(1), NewKeyHasher().Hash(1), "seeds should differ")
+
+	// every symbol of hash is evenly distributed for sequential keys
+	const n = 32000
+	for _, shift := range []uint{0, 30, 55} {
+		counts := make([]int, cardinality)
+		for k := Key(0); k < n; k++ {
+			counts[(h.Hash(k)>>shift)&hashSymbolMask]++
+		}
+		for symbol, c := range counts {
+			assert.InDelta(t, n/cardinality, c, float64(n/cardinality/5), "shift=%d symbol=%d", shift, symbol)
+		}
+	}
+
+	m := New[Key, Value](IdentityHasher{})
+	keys, vals := genTestKVs(10000, 1e6)
+	for i := range keys {
+		m.Add(&keys[i], &vals[i])
+	}
+	for i := range keys {
+		assert.Equal(t, &vals[i], m.Find(&keys[i]))
+	}
+}
+
+func TestMap_PathCompression(t *testing.T) {
+	m := New[Key, Value](IdentityHasher{})
+	keys, vals := []Key{0, 1 << 60}, []Value{1, 2}
+	m.Add(&keys[0], &vals[0])
+	m.Add(&keys[1], &vals[1])
+
+	// 12 shared symbols are skipped by one prefix node
+	assert.True(t, m.root.isPrefix())
+	assert.Equal(t, 12, m.root.asPrefixNode().symbols())
+	assert.Equal(t, 4*entrySize, m.allocator.Stats().InUseBytes)
+	missing := Key(1 << 50)
+	assert.Nil(t, m.Find(&missing))
+
+	// keys differ only in a few scattered bits, so that prefix nodes are split and merged
+	r := rand.New(rand.NewSource(1))
+	m = New[Key, Value](IdentityHasher{})
+	ref := make(map[Key]*Value)
+	// map keeps the first pointer added for each key, which must be kept alive
+	held := make([]*Key, 0, 20000)
+	for i := 0; i < 20000; i++ {
+		k := new(Key)
+		*k = Key(r.Intn(4)<<10 | r.Intn(4)<<35 | r.Intn(4)<<58 | r.Intn(1<<8)<<20)
+		held = append(held, k)
+		if r.Intn(3) == 0 {
+			v, ok := m.Delete(k)
+			assert.Equal(t, ref[*k] != nil, ok, "key=%#x", *k)
+			assert.Equal(t, ref[*k], v, "key=%#x", *k)
+			delete(ref, *k)
+			continue
+		}
+		v := new(Value)
+		*v = Value(i)
+		m.Add(k, v)
+		ref[*k] = v
+	}
+	assert.Equal(t, len(ref), m.Count())
+	for k, v := range ref {
+		assert.Equal(t, v, m.Find(&k), "key=%#x", k)
+	}
+	n := 0
+	for range m.All() {
+		n++
+	}
+	assert.Equal(t, len(ref), n)
+
+	for k := range ref {
+		_, ok := m.Delete(&k)
+		assert.True(t, ok)
+	}
+	assert.Nil(t, m.root)
+	assert.Equal(t, uintptr(0), m.allocator.Stats().InUseBytes)
+	runtime.KeepAlive(held)
+}
+
+func TestMap_StringKey(t *testing.T) {
+	m := New[string, int](NewStringHasher())
+
+	keys := []string{}
+	vals := []int{}
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+		vals = append(vals, i)
+	}
+
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+	assert.Equal(t, len(keys), m.Count())
+
+	for i := 0; i < len(keys); i++ {
+		k := fmt.Sprintf("key-%d", i)
+		assert.Equal(t, &vals[i], m.Find(&k), "key=%s", k)
+	}
+}
+
+// collisionHasher hash keys to only 4 distinct values so that buckets are created
+type collisionHasher struct{}
+
+func (collisionHasher) Hash(k []byte) uint64 {
+	return uint64(k[len(k)-1] % 4)
+}
+
+func (collisionHasher) Equal(a, b []byte) bool {
+	return string(a) == string(b)
+}
+
+func TestMap_Bucket(t *testing.T) {
+	m := New[[]byte, int](collisionHasher{})
+
+	keys := [][]byte{}
+	vals := []int{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		vals = append(vals, i)
+	}
+
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+	assert.Equal(t, len(keys), m.Count())
+
+	for i := 0; i < len(keys); i++ {
+		assert.Equal(t, &vals[i], m.Find(&keys[i]), "key=%s", keys[i])
+	}
+
+	for i := 0; i < len(keys); i++ {
+		v, ok := m.Delete(&keys[i])
+		assert.True(t, ok)
+		assert.Equal(t, &vals[i], v, "key=%s", keys[i])
+		for j := i + 1; j < len(keys); j++ {
+			assert.Equal(t, &vals[j], m.Find(&keys[j]), "key=%s", keys[j])
+		}
+	}
+	assert.Equal(t, 0, m.Count())
+	assert.Nil(t, m.root)
+}
+
+// clusterRehasher hasher whose first hash puts all keys in 8 clusters, so they are told apart by Rehash only
+type clusterRehasher struct {
+	KeyHasher
+}
+
+func (h clusterRehasher) Hash(k Key) uint64 {
+	return uint64(k % 8)
+}
+
+func TestMap_SymbolWidth(t *testing.T) {
+	assert.Panics(t, func() { WithSymbolWidth(7) })
+
+	for _, w := range []uint{4, 5, 6} {
+		r := rand.New(rand.NewSource(int64(w)))
+		m := New[Key, Value](clusterRehasher{NewKeyHasher()}, WithSymbolWidth(w), WithOwnedStorage())
+		ref := make(map[Key]Value)
+		for i := 0; i < 20000; i++ {
+			k := Key(r.Intn(5000))
+			if r.Intn(3) == 0 {
+				v, ok := m.Delete(&k)
+				_, present := ref[k]
+				assert.Equal(t, present, ok, "width=%d key=%d", w, k)
+				if ok {
+					assert.Equal(t, ref[k], *v, "width=%d key=%d", w, k)
+				}
+				delete(ref, k)
+				continue
+			}
+			v := Value(i)
+			m.Add(&k, &v)
+			ref[k] = v
+		}
+		assert.Equal(t, len(ref), m.Count())
+		for k, v := range ref {
+			assert.Equal(t, &v, m.Find(&k), "width=%d key=%d", w, k)
+		}
+		n := 0
+		for range m.All() {
+			n++
+		}
+		assert.Equal(t, len(ref), n)
+		// colliding keys are rehashed instead of put in a bucket
+		assert.NotContains(t, debugMap(m), "bucket", "width=%d", w)
+
+		for k := range ref {
+			_, ok := m.Delete(&k)
+			assert.True(t, ok)
+		}
+		assert.Nil(t, m.root)
+		assert.Equal(t, uintptr(0), m.allocator.Stats().InUseBytes)
+	}
+}
+
+// maskHasher hasher of Key ignoring masked bits of key, so that keys differing only in them collide
+type maskHasher uint64
+
+func (h maskHasher) Hash(k Key) uint64 {
+	return uint64(k) &^ uint64(h)
+}
+
+func (maskHasher) Equal(a, b Key) bool {
+	return a == b
+}
+
+func TestMap_BucketWithoutRehash(t *testing.T) {
+	// 0 and 1<<63 differ in the last symbol only, and 1<<62 collides with 0 in all bits
+	keys, vals := []Key{0, -1 << 63, 1 << 62}, []Value{1, 2, 3}
+	for _, w := range []uint{4, 5, 6} {
+		for _, opts := range [][]Option{{WithSymbolWidth(w)}, {WithSymbolWidth(w), WithOwnedStorage()}} {
+			m := New[Key, Value](maskHasher(1<<62), opts...)
+			for i := range keys {
+				m.Add(&keys[i], &vals[i])
+			}
+			assert.Equal(t, len(keys), m.Count())
+			assert.Contains(t, debugMap(m), "bucket", "width=%d", w)
+			for i := range keys {
+				assert.Equal(t, vals[i], *m.Find(&keys[i]), "width=%d key=%#x", w, keys[i])
+			}
+			for i := range keys {
+				v, ok := m.Delete(&keys[i])
+				assert.True(t, ok)
+				assert.Equal(t, vals[i], *v)
+			}
+			assert.Nil(t, m.root)
+		}
+	}
+}
+
+func TestMap_OwnedStorage(t *testing.T) {
+	m := New[string, []int](NewStringHasher(), WithOwnedStorage())
+
+	add := func(i int) {
+		// key/val are not kept alive by caller
+		k := fmt.Sprintf("key-%d", i)
+		v := []int{i}
+		m.Add(&k, &v)
+	}
+	for i := 0; i < 10000; i++ {
+		add(i)
+	}
+	runtime.GC()
+
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		v := m.Find(&k)
+		assert.Equal(t, []int{i}, *v, "key=%s", k)
+	}
+
+	for i := 0; i < 10000; i += 2 {
+		k := fmt.Sprintf("key-%d", i)
+		v, ok := m.Delete(&k)
+		assert.True(t, ok)
+		assert.Equal(t, []int{i}, *v, "key=%s", k)
+	}
+	for i := 0; i < 10000; i += 2 {
+		add(i + 10000)
+	}
+	runtime.GC()
+
+	assert.Equal(t, 10000, m.Count())
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		if i < 10000 && i%2 == 0 || i >= 10000 && i%2 == 1 {
+			assert.Nil(t, m.Find(&k), "key=%s", k)
+		} else {
+			assert.Equal(t, []int{i}, *m.Find(&k), "key=%s", k)
+		}
+	}
+}
+
+func TestMap_OwnedStorageNilValue(t *testing.T) {
+	m := New[string, []int](NewStringHasher(), WithOwnedStorage())
+
+	k1, k2 := "a", "b"
+	m.Add(&k1, nil)
+	assert.Nil(t, m.Find(&k1))
+	v, ok := m.Compute(&k2, func(old *[]int, present bool) (*[]int, bool) {
+		return nil, true
+	})
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	assert.Equal(t, 2, m.Count())
+	assert.Equal(t, 2, m.Clone().Count())
+
+	v, ok = m.Delete(&k1)
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	v, ok = m.Delete(&k2)
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	assert.Equal(t, 0, m.Count())
+}
+
+func TestMap_Compute(t *testing.T) {
+	// counters of words, with words counted to zero removed
+	m := New[string, int](NewStringHasher(), WithOwnedStorage())
+	words := []string{"a", "b", "a", "c", "a", "b"}
+	incr := func(old *int, present bool) (*int, bool) {
+		n := 1
+		if present {
+			n = *old + 1
+		}
+		return &n, true
+	}
+	for i := range words {
+		m.Compute(&words[i], incr)
+	}
+	assert.Equal(t, 3, m.Count())
+	for k, n := range map[string]int{"a": 3, "b": 2, "c": 1} {
+		assert.Equal(t, n, *m.Find(&k), "key=%s", k)
+	}
+
+	decr := func(old *int, present bool) (*int, bool) {
+		*old--
+		return old, *old > 0
+	}
+	c := "c"
+	v, ok := m.Compute(&c, decr)
+	assert.Nil(t, v)
+	assert.False(t, ok)
+	assert.Nil(t, m.Find(&c))
+	assert.Equal(t, 2, m.Count())
+
+	// absent key is left absent
+	v, ok = m.Compute(&c, func(old *int, present bool) (*int, bool) {
+		assert.Nil(t, old)
+		assert.False(t, present)
+		return nil, false
+	})
+	assert.Nil(t, v)
+	assert.False(t, ok)
+	assert.Equal(t, 2, m.Count())
+
+	// LoadOrStore / Swap / CompareAndSwap
+	x, y := 10, 20
+	actual, loaded := m.LoadOrStore(&c, &x)
+	assert.False(t, loaded)
+	assert.Equal(t, 10, *actual)
+	actual, loaded = m.LoadOrStore(&c, &y)
+	assert.True(t, loaded)
+	assert.Equal(t, 10, *actual)
+
+	prev, loaded := m.Swap(&c, &y)
+	assert.True(t, loaded)
+	assert.Equal(t, 10, *prev)
+	assert.Equal(t, 20, *m.Find(&c))
+	d := "d"
+	prev, loaded = m.Swap(&d, &x)
+	assert.False(t, loaded)
+	assert.Nil(t, prev)
+
+	assert.False(t, m.CompareAndSwap(&c, &y, &x))
+	assert.True(t, m.CompareAndSwap(&c, m.Find(&c), &x))
+	assert.Equal(t, 10, *m.Find(&c))
+	e := "e"
+	assert.False(t, m.CompareAndSwap(&e, nil, &x))
+	assert.Nil(t, m.Find(&e))
+	assert.Equal(t, 4, m.Count())
+
+	// keys in buckets
+	bm := New[[]byte, int](collisionHasher{})
+	keys, vals := make([][]byte, 100), make([]int, 100)
+	for i := range keys {
+		keys[i], vals[i] = []byte(fmt.Sprintf("key-%d", i)), i
+		_, loaded := bm.LoadOrStore(&keys[i], &vals[i])
+		assert.False(t, loaded)
+	}
+	for i := range keys {
+		v, ok := bm.Compute(&keys[i], func(old *int, present bool) (*int, bool) {
+			assert.True(t, present)
+			assert.Equal(t, i, *old)
+			return old, i%2 == 0
+		})
+		assert.Equal(t, i%2 == 0, ok)
+		if ok {
+			assert.Equal(t, i, *v)
+		}
+	}
+	assert.Equal(t, len(keys)/2, bm.Count())
+	for i := range keys {
+		if i%2 == 0 {
+			assert.Equal(t, i, *bm.Find(&keys[i]))
+		} else {
+			assert.Nil(t, bm.Find(&keys[i]))
+		}
+	}
+}
+
+func TestMap_DiffMerge(t *testing.T) {
+	keys, vals := genTestKVs(5000, 1e7)
+	newB := map[string]func(a *Map[Key, Value]) *Map[Key, Value]{
+		// next generation placing keys the same way, whose trie is walked together
+		"clone": func(a *Map[Key, Value]) *Map[Key, Value] { return a.Clone() },
+		// maps of different layout compared by lookup
+		"new":   func(*Map[Key, Value]) *Map[Key, Value] { return NewMap() },
+		"width": func(a *Map[Key, Value]) *Map[Key, Value] { return New[Key, Value](a.Hasher(), WithSymbolWidth(4)) },
+	}
+	for name, newB := range newB {
+		// b removes every 5th key of a, changes every 7th, and adds 1000 keys
+		a := NewMap()
+		for i := 0; i < 4000; i++ {
+			a.Add(&keys[i], &vals[i])
+		}
+		assert.True(t, Equal(a, a))
+		assert.Equal(t, Delta[Key, Value]{}, Diff(a, a))
+
+		b := newB(a)
+		assert.Equal(t, name == "clone", sameLayout(a, b), name)
+		assert.Equal(t, name == "clone", Equal(a, b), name)
+		changed := make([]Value, 4000)
+		for i := len(keys) - 1; i >= 0; i-- {
+			switch {
+			case i >= 4000:
+				b.Add(&keys[i], &vals[i])
+			case i%5 == 0:
+				b.Delete(&keys[i])
+			case i%7 == 0:
+				changed[i] = vals[i] + 1
+				b.Add(&keys[i], &changed[i])
+			default:
+				b.Add(&keys[i], &vals[i])
+			}
+		}
+		assert.False(t, Equal(a, b))
+
+		d := Diff(a, b)
+		assert.Len(t, d.Added, 1000)
+		for _, c := range d.Added {
+			assert.Nil(t, a.Find(c.Key))
+			assert.Equal(t, b.Find(c.Key), c.New)
+		}
+		assert.Len(t, d.Removed, 800)
+		for _, c := range d.Removed {
+			assert.Nil(t, b.Find(c.Key))
+			assert.Equal(t, a.Find(c.Key), c.Old)
+		}
+		assert.Len(t, d.Changed, 4000/7-4000/35)
+		for _, c := range d.Changed {
+			assert.Equal(t, *c.Old+1, *c.New)
+		}
+
+		// values of changed keys are summed, others are taken from either map
+		sums := make([]Value, len(keys))
+		m := Merge(a, b, func(k *Key, va, vb *Value) (*Value, bool) {
+			i := slices.Index(keys, *k)
+			sums[i] = *va + *vb
+			return &sums[i], true
+		})
+		assert.Equal(t, len(keys), m.Count())
+		for i := range keys {
+			want := vals[i]
+			if i < 4000 && i%5 != 0 && i%7 == 0 {
+				want = vals[i] + changed[i]
+			}
+			assert.Equal(t, want, *m.Find(&keys[i]), "key=%d", keys[i])
+		}
+		assert.True(t, Equal(Merge(a, New[Key, Value](a.Hasher()), nil), a))
+
+		// replaying delta on a makes it equal to b
+		for _, c := range d.Removed {
+			a.Delete(c.Key)
+		}
+		for _, c := range append(d.Added, d.Changed...) {
+			a.Add(c.Key, c.New)
+		}
+		assert.True(t, Equal(a, b))
+		assert.True(t, Equal(b, a))
+		assert.Equal(t, Delta[Key, Value]{}, Diff(a, b))
+	}
+}
+
+func TestMap_DiffBucket(t *testing.T) {
+	// keys colliding in all hash bits are in buckets of both maps
+	keys, vals := []Key{0, 1 << 62, 1 << 61}, []Value{1, 2, 3}
+	a := New[Key, Value](maskHasher(3<<61), WithOwnedStorage())
+	a.Add(&keys[0], &vals[0])
+	a.Add(&keys[1], &vals[1])
+	b := a.Clone()
+	b.Add(&keys[2], &vals[2])
+
+	assert.False(t, Equal(a, b))
+	assert.Equal(t, Delta[Key, Value]{Added: []Change[Key, Value]{{Key: &keys[2], New: &vals[2]}}}, Diff(a, b))
+	first := func(_ *Key, va, _ *Value) (*Value, bool) { return va, true }
+	assert.True(t, Equal(Merge(a, b, first), b))
+	b.Delete(&keys[2])
+	assert.True(t, Equal(a, b))
+}
+
+func TestMap_DiffNilValue(t *testing.T) {
+	keys, vals := []Key{1, 2, 3}, []Value{1, 2, 3}
+	a := New[Key, Value](IdentityHasher{})
+	for i := range keys {
+		a.Add(&keys[i], nil)
+	}
+	b := a.Clone()
+	assert.True(t, Equal(a, b))
+	assert.True(t, Equal(a, Merge(New[Key, Value](IdentityHasher{}), a, nil)))
+
+	// nil value is neither a missing key nor equal to other values
+	b.Add(&keys[0], &vals[0])
+	b.Delete(&keys[1])
+	c := New[Key, Value](IdentityHasher{}, WithSymbolWidth(4))
+	c.Add(&keys[0], nil)
+	c.Add(&keys[1], nil)
+	for _, a := range []*Map[Key, Value]{a, c} {
+		assert.False(t, Equal(a, b))
+		d := Diff(a, b)
+		assert.Equal(t, []Change[Key, Value]{{Key: &keys[0], New: &vals[0]}}, d.Changed)
+		assert.Equal(t, []Change[Key, Value]{{Key: &keys[1]}}, d.Removed)
+	}
+
+	// key is kept with nil value from resolve, or removed by it
+	m := Merge(a, b, func(k *Key, va, vb *Value) (*Value, bool) { return nil, *k == keys[0] })
+	assert.Equal(t, 3, m.Count())
+	assert.True(t, Equal(a, m))
+	m = Merge(a, b, func(k *Key, va, vb *Value) (*Value, bool) { return vb, false })
+	assert.Equal(t, 2, m.Count())
+	assert.Nil(t, m.Find(&keys[0]))
+	assert.Nil(t, m.Find(&keys[1]))
+}
+
+func TestMap_CloneCopyOnWrite(t *testing.T) {
+	// the first 4096 keys fill two levels of 64-way AMT nodes, the rest are added later
+	keys, vals := make([]Key, 5000), make([]Value, 5000)
+	for i := range keys {
+		keys[i], vals[i] = Key(i), Value(i)
+	}
+	for _, owned := range []bool{false, true} {
+		var opts []Option
+		if owned {
+			opts = append(opts, WithOwnedStorage())
+		}
+		a := New[Key, Value](IdentityHasher{}, opts...)
+		for i := 0; i < 4096; i++ {
+			a.Add(&keys[i], &vals[i])
+		}
+
+		// b changes a few keys, which are all that's left after skipping shared sub-tries
+		b := a.Clone()
+		changed := Value(-1)
+		b.Add(&keys[0], &changed)
+		b.Delete(&keys[1])
+		b.Add(&keys[4096], &vals[4096])
+		calls := 0
+		zipMaps(a, b, func(*Key, *Value, *Value, bool, bool) bool {
+			calls++
+			return true
+		})
+		assert.Equal(t, 3, calls, "owned=%v", owned)
+
+		// generations are modified independently
+		c := b.Clone()
+		for i := 0; i < 4096; i += 2 {
+			c.Delete(&keys[i])
+		}
+		for i := 4096; i < len(keys); i++ {
+			c.Add(&keys[i], &vals[i])
+		}
+		assert.Equal(t, 4096, a.Count())
+		assert.Equal(t, 4096, b.Count())
+		assert.Equal(t, 2047+904, c.Count())
+		for i := range keys {
+			va, vb, vc := a.Find(&keys[i]), b.Find(&keys[i]), c.Find(&keys[i])
+			switch {
+			case i >= 4096:
+				assert.Nil(t, va)
+			default:
+				assert.Equal(t, vals[i], *va, "owned=%v key=%d", owned, keys[i])
+			}
+			switch {
+			case i == 0:
+				assert.Equal(t, changed, *vb)
+			case i == 1 || i > 4096:
+				assert.Nil(t, vb)
+			default:
+				assert.Equal(t, vals[i], *vb, "owned=%v key=%d", owned, keys[i])
+			}
+			switch {
+			case i < 4096 && i%2 == 0 || i == 1:
+				assert.Nil(t, vc)
+			default:
+				assert.Equal(t, vals[i], *vc, "owned=%v key=%d", owned, keys[i])
+			}
+		}
+
+		// clearing old generations leaves the rest alone
+		a.Clear()
+		b.Clear()
+		assert.Equal(t, 0, a.Count())
+		assert.Nil(t, b.Find(&keys[3]))
+		for i := 3; i < 4096; i += 2 {
+			c.Delete(&keys[i])
+		}
+		assert.Equal(t, 904, c.Count())
+		assert.Equal(t, vals[4999], *c.Find(&keys[4999]))
+	}
+}
+
+func genTestKVs(n int, max int64) ([]Key, []Value) {
+	keys := []Key{}
+	vals := []Value{}
+	keyMap := make(map[Key]bool)
+
+	for len(keys) < n {
+		k := Key(rand.Int63n(max))
+		if !keyMap[k] {
+			keyMap[k] = true
+			keys = append(keys, k)
+			vals = append(vals, Value(len(keys)))
+		}
+	}
+
+	return keys, vals
+}
+
+func TestMap_Range(t *testing.T) {
+	m := NewMap()
+
+	keys, vals := genTestKVs(10000, 1e7)
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+
+	want := make(map[*Key]*Value)
+	for i := 0; i < len(keys); i++ {
+		want[&keys[i]] = &vals[i]
+	}
+
+	got := make(map[*Key]*Value)
+	for k, v := range m.All() {
+		got[k] = v
+	}
+	assert.Equal(t, want, got)
+
+	var order []*Key
+	for k := range m.Keys() {
+		order = append(order, k)
+	}
+	i := 0
+	for v := range m.Values() {
+		assert.Equal(t, want[order[i]], v)
+		i++
+	}
+	assert.Equal(t, len(keys), i)
+
+	visited := 0
+	m.Range(func(k *Key, v *Value) bool {
+		visited++
+		return visited < 100
+	})
+	assert.Equal(t, 100, visited)
+
+	empty := NewMap()
+	for range empty.All() {
+		t.Fatal("empty map should have no entries")
+	}
+}
+
+func TestMap_RangeBucket(t *testing.T) {
+	m := New[[]byte, int](collisionHasher{})
+
+	want := make(map[string]int)
+	keys := [][]byte{}
+	vals := []int{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		vals = append(vals, i)
+		want[string(keys[i])] = i
+	}
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+
+	got := make(map[string]int)
+	for k, v := range m.All() {
+		got[string(*k)] = *v
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestMap_Snapshot(t *testing.T) {
+	m := NewMap()
+	keys, vals := genTestKVs(100000, 1e12)
+	for i := range keys {
+		m.Add(&keys[i], &vals[i])
+	}
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	data := buf.Bytes()
+
+	// trailing data is not consumed
+	r := bytes.NewReader(append(slices.Clone(data), "tail"...))
+	loaded, err := ReadFrom(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, r.Len())
+	assert.NotNil(t, loaded.slots)
+	assert.Equal(t, m.Count(), loaded.Count())
+	for i := range keys {
+		k := keys[i]
+		assert.Equal(t, vals[i], *loaded.Find(&k), "key=%d", k)
+	}
+
+	// corrupted snapshots
+	bad := slices.Clone(data)
+	bad[len(bad)/2] ^= 1
+	_, err = ReadFrom(bytes.NewReader(bad))
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+	_, err = ReadFrom(bytes.NewReader(data[:len(data)-1]))
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+	bad = slices.Clone(data)
+	bad[4] = snapshotVersion + 1
+	_, err = ReadFrom(bytes.NewReader(bad))
+	assert.ErrorIs(t, err, ErrSnapshotVersion)
+
+	// fixed-size struct key
+	type point struct{ X, Y, Z int32 }
+	pm := New[point, float64](NewComparableHasher[point]())
+	for i := 0; i < 1000; i++ {
+		k, v := point{int32(i), int32(-i), 1}, float64(i)/2
+		pm.Add(&k, &v)
+	}
+	buf.Reset()
+	_, err = pm.WriteTo(&buf)
+	assert.NoError(t, err)
+	_, err = ReadFrom(bytes.NewReader(buf.Bytes()))
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted) // size mismatch
+	pl, err := Load[point, float64](&buf, NewComparableHasher[point]())
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, pl.Count())
+	for i := 0; i < 1000; i++ {
+		k := point{int32(i), int32(-i), 1}
+		assert.Equal(t, float64(i)/2, *pl.Find(&k))
+	}
+
+	_, err = New[string, int](NewStringHasher()).WriteTo(&buf)
+	assert.ErrorIs(t, err, ErrNotFixedSize)
+}
+
+func TestMap_SnapshotNilValue(t *testing.T) {
+	m := NewMap(WithOwnedStorage())
+	for i := 0; i < 100; i++ {
+		k, v := Key(i), Value(i)
+		if i%3 == 0 {
+			m.Add(&k, nil)
+		} else {
+			m.Add(&k, &v)
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	assert.NoError(t, err)
+	data := buf.Bytes()
+	loaded, err := ReadFrom(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 100, loaded.Count())
+	loaded.Range(func(k *Key, v *Value) bool {
+		if *k%3 == 0 {
+			assert.Nil(t, v, "key=%d", *k)
+		} else {
+			assert.Equal(t, Value(*k), *v, "key=%d", *k)
+		}
+		return true
+	})
+
+	// flag other than 0/1 is rejected even with valid checksum
+	bad := slices.Clone(data)
+	bad[snapshotHeadSize+8] = 2
+	binary.LittleEndian.PutUint32(bad[len(bad)-4:], crc32.Checksum(bad[:len(bad)-4], crcTable))
+	_, err = ReadFrom(bytes.NewReader(bad))
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+}
+
+func TestPersistentMap(t *testing.T) {
+	keys, vals := genTestKVs(10000, 1e7)
+
+	versions := []*PersistentMap[Key, Value]{NewPersistentMap()}
+	for i := 0; i < len(keys); i++ {
+		versions = append(versions, versions[i].With(&keys[i], &vals[i]))
+	}
+
+	// every version only sees keys added before it
+	for _, n := range []int{0, 1, 100, 5000, len(keys)} {
+		m := versions[n]
+		assert.Equal(t, n, m.Count())
+		for i := 0; i < len(keys); i++ {
+			if i < n {
+				assert.Equal(t, &vals[i], m.Find(&keys[i]), "key=%d version=%d", keys[i], n)
+			} else {
+				assert.Nil(t, m.Find(&keys[i]), "key=%d version=%d", keys[i], n)
+			}
+		}
+	}
+
+	full := versions[len(keys)]
+	m := full
+	for i := 0; i < len(keys); i += 2 {
+		m = m.Without(&keys[i])
+	}
+	assert.Equal(t, len(keys)/2, m.Count())
+	assert.Equal(t, len(keys), full.Count())
+	for i := 0; i < len(keys); i++ {
+		assert.Equal(t, &vals[i], full.Find(&keys[i]), "key=%d", keys[i])
+		if i%2 == 0 {
+			assert.Nil(t, m.Find(&keys[i]), "key=%d", keys[i])
+		} else {
+			assert.Equal(t, &vals[i], m.Find(&keys[i]), "key=%d", keys[i])
+		}
+	}
+	assert.Same(t, m, m.Without(&keys[0]))
+
+	visited := 0
+	for k, v := range m.All() {
+		assert.Equal(t, v, m.Find(k))
+		visited++
+	}
+	assert.Equal(t, m.Count(), visited)
+
+	for i := 1; i < len(keys); i += 2 {
+		m = m.Without(&keys[i])
+	}
+	assert.Equal(t, 0, m.Count())
+	assert.Nil(t, m.root)
+}
+
+func TestPersistentMap_StructuralSharing(t *testing.T) {
+	keys, vals := genTestKVs(10000, 1e7)
+
+	m1 := NewPersistentMap()
+	for i := 0; i < len(keys); i++ {
+		m1 = m1.With(&keys[i], &vals[i])
+	}
+
+	v := Value(-1)
+	m2 := m1.With(&keys[0], &v)
+	assert.Equal(t, &vals[0], m1.Find(&keys[0]))
+	assert.Equal(t, &v, m2.Find(&keys[0]))
+
+	// only one child of root is on the path to the changed entry
+	changed := 0
+	for i := range m1.root.sub {
+		if &m1.root.sub[i].sub[0] != &m2.root.sub[i].sub[0] {
+			changed++
+		}
+	}
+	assert.Equal(t, 1, changed)
+}
+
+func TestPersistentMap_Bucket(t *testing.T) {
+	keys := [][]byte{}
+	vals := []int{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		vals = append(vals, i)
+	}
+
+	m := NewPersistent[[]byte, int](collisionHasher{})
+	for i := 0; i < len(keys); i++ {
+		m = m.With(&keys[i], &vals[i])
+	}
+	assert.Equal(t, len(keys), m.Count())
+
+	for i := 0; i < len(keys); i++ {
+		assert.Equal(t, &vals[i], m.Find(&keys[i]), "key=%s", keys[i])
+		m = m.Without(&keys[i])
+		for j := i + 1; j < len(keys); j++ {
+			assert.Equal(t, &vals[j], m.Find(&keys[j]), "key=%s", keys[j])
+		}
+	}
+	assert.Equal(t, 0, m.Count())
+}
+
+func TestConcurrentMap(t *testing.T) {
+	const writers = 8
+	keys, vals := genTestKVs(8000, 1e7)
+	m := NewConcurrentMap()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(keys); i += writers {
+				m.Add(&keys[i], &vals[i])
+			}
+			for i := w; i < len(keys); i += 2 * writers {
+				v, ok := m.Delete(&keys[i])
+				assert.True(t, ok)
+				assert.Equal(t, &vals[i], v)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < len(keys); i++ {
+				if v := m.Find(&keys[i]); v != nil {
+					assert.Equal(t, &vals[i], v)
+				}
+			}
+		}()
+	}
+
+	snapshot := m.Snapshot()
+	wg.Wait()
+
+	assert.Equal(t, len(keys)/2, m.Count())
+	for i := 0; i < len(keys); i++ {
+		if i%(2*writers) < writers {
+			assert.Nil(t, m.Find(&keys[i]), "key=%d", keys[i])
+		} else {
+			assert.Equal(t, &vals[i], m.Find(&keys[i]), "key=%d", keys[i])
+		}
+	}
+
+	// snapshot is not affected by later modification
+	n := 0
+	snapshot.Range(func(k *Key, v *Value) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, snapshot.Count(), n)
+}
+
+func TestConcurrentMap_Snapshot(t *testing.T) {
+	const writers = 4
+	keys, vals := genTestKVs(4000, 1e7)
+	m := NewConcurrentMap()
+
+	// each writer adds its keys in order, so a consistent snapshot holds a prefix of them
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(keys); i += writers {
+				m.Add(&keys[i], &vals[i])
+			}
+		}(w)
+	}
+	var snapshots []*ConcurrentMap[Key, Value]
+	for i := 0; i < 20; i++ {
+		snapshots = append(snapshots, m.Snapshot())
+	}
+	wg.Wait()
+
+	for _, s := range snapshots {
+		for w := 0; w < writers; w++ {
+			present := true
+			for i := w; i < len(keys); i += writers {
+				v := s.Find(&keys[i])
+				if !present {
+					assert.Nil(t, v, "key=%d", keys[i])
+					continue
+				}
+				if v == nil {
+					present = false
+				} else {
+					assert.Equal(t, &vals[i], v, "key=%d", keys[i])
+				}
+			}
+		}
+	}
+
+	// snapshot and map are modified independently
+	s := m.Snapshot()
+	for i := 0; i < len(keys); i += 2 {
+		m.Delete(&keys[i])
+	}
+	v := Value(-1)
+	s.Add(&keys[1], &v)
+	assert.Equal(t, len(keys)/2, m.Count())
+	assert.Equal(t, len(keys), s.Count())
+	for i := 0; i < len(keys); i++ {
+		switch {
+		case i == 1:
+			assert.Equal(t, &vals[i], m.Find(&keys[i]))
+			assert.Equal(t, &v, s.Find(&keys[i]))
+		case i%2 == 0:
+			assert.Nil(t, m.Find(&keys[i]), "key=%d", keys[i])
+			assert.Equal(t, &vals[i], s.Find(&keys[i]), "key=%d", keys[i])
+		default:
+			assert.Equal(t, &vals[i], m.Find(&keys[i]), "key=%d", keys[i])
+			assert.Equal(t, &vals[i], s.Find(&keys[i]), "key=%d", keys[i])
+		}
+	}
+}
+
+func TestConcurrentMap_Bucket(t *testing.T) {
+	keys := [][]byte{}
+	vals := []int{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		vals = append(vals, i)
+	}
+
+	m := NewConcurrent[[]byte, int](collisionHasher{})
+	for i := 0; i < len(keys); i++ {
+		m.Add(&keys[i], &vals[i])
+	}
+	assert.Equal(t, len(keys), m.Count())
+	m.Add(&keys[0], &vals[1])
+	assert.Equal(t, &vals[1], m.Find(&keys[0]))
+	assert.Equal(t, len(keys), m.Count())
+
+	for i := 0; i < len(keys); i++ {
+		_, ok := m.Delete(&keys[i])
+		assert.True(t, ok, "key=%s", keys[i])
+		for j := i + 1; j < len(keys); j++ {
+			assert.Equal(t, &vals[j], m.Find(&keys[j]), "key=%s", keys[j])
+		}
+	}
+	assert.Equal(t, 0, m.Count())
+}
+
+func TestConcurrentMap_NilValue(t *testing.T) {
+	m := NewConcurrentMap()
+	k := Key(1)
+	m.Add(&k, nil)
+	assert.Equal(t, 1, m.Count())
+
+	v, ok := m.Delete(&k)
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	assert.Equal(t, 0, m.Count())
+
+	_, ok = m.Delete(&k)
+	assert.False(t, ok)
+}
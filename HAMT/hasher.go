@@ -0,0 +1,152 @@
+package hamt
+
+import (
+	"bytes"
+	"hash/maphash"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// Hasher hash function and equality of map key.
+// Keys equal to each other must have the same hash.
+type Hasher[K any] interface {
+	Hash(k K) uint64
+	Equal(a, b K) bool
+}
+
+// Rehasher hasher able to compute more hashes of key independent of each other.
+// Map uses them to go on with the trie when keys collide in all 64 bits of hash.
+type Rehasher[K any] interface {
+	Hasher[K]
+	// Rehash hash of key in round (>= 1), round 0 is Hash
+	Rehash(k K, round int) uint64
+}
+
+const (
+	signBitMask = uint64(1) << 63
+
+	// wyhash secrets
+	wyp0 = 0xa0761d6478bd642f
+	wyp1 = 0xe7037ed1a0b428db
+)
+
+// KeyHasher hasher of Key mixing all bits of key with a random seed (wyhash), so that the trie stays
+// balanced for sequential or clustered keys and collisions can't be forced without knowing the seed.
+// The zero value is usable but unseeded, use `NewKeyHasher` to get a seeded one.
+type KeyHasher struct {
+	seed uint64
+}
+
+func NewKeyHasher() KeyHasher {
+	s := rand.Uint64()
+	return KeyHasher{seed: s ^ wymix(s^wyp0, wyp1)}
+}
+
+func (h KeyHasher) Hash(k Key) uint64 {
+	a := uint64(k)
+	b := bits.RotateLeft64(a, 32)
+	return wymix(wyp1^8, wymix(a^wyp1, b^h.seed))
+}
+
+func (h KeyHasher) Rehash(k Key, round int) uint64 {
+	return KeyHasher{seed: wymix(h.seed^uint64(round), wyp0)}.Hash(k)
+}
+
+func (KeyHasher) Equal(a, b Key) bool {
+	return a == b
+}
+
+// wymix multiply a and b to 128 bits and fold it
+func wymix(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+// IdentityHasher hasher of Key using bits of key as hash, so the shape of trie follows key bits.
+// It is faster than KeyHasher but only suitable for keys which are already well distributed.
+type IdentityHasher struct{}
+
+func (IdentityHasher) Hash(k Key) uint64 {
+	return uint64(k) ^ signBitMask
+}
+
+func (IdentityHasher) Equal(a, b Key) bool {
+	return a == b
+}
+
+// StringHasher hasher of string key
+type StringHasher struct {
+	seed maphash.Seed
+}
+
+func NewStringHasher() StringHasher {
+	return StringHasher{seed: maphash.MakeSeed()}
+}
+
+func (h StringHasher) Hash(k string) uint64 {
+	return maphash.String(h.seed, k)
+}
+
+func (h StringHasher) Rehash(k string, round int) uint64 {
+	mh := roundHash(h.seed, round)
+	mh.WriteString(k)
+	return mh.Sum64()
+}
+
+func (StringHasher) Equal(a, b string) bool {
+	return a == b
+}
+
+// BytesHasher hasher of byte slice key
+type BytesHasher struct {
+	seed maphash.Seed
+}
+
+func NewBytesHasher() BytesHasher {
+	return BytesHasher{seed: maphash.MakeSeed()}
+}
+
+func (h BytesHasher) Hash(k []byte) uint64 {
+	return maphash.Bytes(h.seed, k)
+}
+
+func (h BytesHasher) Rehash(k []byte, round int) uint64 {
+	mh := roundHash(h.seed, round)
+	mh.Write(k)
+	return mh.Sum64()
+}
+
+func (BytesHasher) Equal(a, b []byte) bool {
+	return bytes.Equal(a, b)
+}
+
+// ComparableHasher hasher of any comparable key, e.g. struct
+type ComparableHasher[K comparable] struct {
+	seed maphash.Seed
+}
+
+func NewComparableHasher[K comparable]() ComparableHasher[K] {
+	return ComparableHasher[K]{seed: maphash.MakeSeed()}
+}
+
+func (h ComparableHasher[K]) Hash(k K) uint64 {
+	return maphash.Comparable(h.seed, k)
+}
+
+func (h ComparableHasher[K]) Rehash(k K, round int) uint64 {
+	mh := roundHash(h.seed, round)
+	maphash.WriteComparable(mh, k)
+	return mh.Sum64()
+}
+
+func (ComparableHasher[K]) Equal(a, b K) bool {
+	return a == b
+}
+
+// roundHash maphash.Hash of seed whose state is diverted by round
+func roundHash(seed maphash.Seed, round int) *maphash.Hash {
+	mh := new(maphash.Hash)
+	mh.SetSeed(seed)
+	mh.WriteByte(byte(round))
+	return mh
+}
@@ -0,0 +1,75 @@
+package hamt
+
+import (
+	"iter"
+)
+
+// Range call fn for each key/value in map until fn returns false.
+// Children of AMT nodes are visited in bitmap order so the order is stable as long as map is not modified.
+// NOTE: map must not be modified during iteration.
+func (m *Map[K, V]) Range(fn func(k *K, v *V) bool) {
+	if m.root == nil {
+		return
+	}
+	m.walk(m.root, 0, fn)
+}
+
+// All iterator over key/value pairs of map in the same order as Range
+func (m *Map[K, V]) All() iter.Seq2[*K, *V] {
+	return m.Range
+}
+
+// Keys iterator over keys of map in the same order as Range
+func (m *Map[K, V]) Keys() iter.Seq[*K] {
+	return func(yield func(*K) bool) {
+		m.Range(func(k *K, _ *V) bool {
+			return yield(k)
+		})
+	}
+}
+
+// Values iterator over values of map in the same order as Range
+func (m *Map[K, V]) Values() iter.Seq[*V] {
+	return func(yield func(*V) bool) {
+		m.Range(func(_ *K, v *V) bool {
+			return yield(v)
+		})
+	}
+}
+
+// walk visit sub-trie depth-first, return false if stopped by fn
+func (m *Map[K, V]) walk(e *entry, shiftBits uint, fn func(k *K, v *V) bool) bool {
+	if e.isLeaf() {
+		kv := asKVPair[K, V](e)
+		return fn(kv.key, kv.val)
+	}
+
+	if shiftBits >= m.maxBits {
+		b := e.asKVBucket()
+		for i := 0; i < int(b.count); i++ {
+			kv := asKVPair[K, V](b.base.entryAt(i))
+			if !fn(kv.key, kv.val) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if e.isPrefix() {
+		p := e.asPrefixNode()
+		return m.walk(p.base().entryAt(0), shiftBits+p.bits(m.width), fn)
+	}
+
+	n := e.asAMTNode()
+	for i := 0; i < n.childNum(); i++ {
+		if !m.walk(n.base.entryAt(i), shiftBits+m.width, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// All iterator over key/value pairs of persistent map in the same order as Range
+func (m *PersistentMap[K, V]) All() iter.Seq2[*K, *V] {
+	return m.Range
+}
@@ -0,0 +1,249 @@
+package hamt
+
+// PersistentMap immutable hash array mapped trie.
+// `With` and `Without` return a new map which copies only the path from root to the changed entry
+// and shares all other sub-tries with the old one, so every version stays valid and can be read
+// concurrently without locking.
+// NOTE: keys/values are kept by pointer, caller must not modify them after adding.
+type PersistentMap[K, V any] struct {
+	count  int
+	root   *pentry[K, V]
+	hasher Hasher[K]
+}
+
+// pentry counterpart of `entry` in GC managed memory, it's one of:
+//   - leaf: key/val pair, sub is nil
+//   - AMT node: bitmap and its sub-trie
+//   - bucket: sub holds leaves with conflict hash when hash runs out
+type pentry[K, V any] struct {
+	key    *K
+	val    *V
+	bitmap bitmap
+	sub    []pentry[K, V]
+}
+
+// NewPersistent create an empty persistent map using hasher h for hash and equality of keys
+func NewPersistent[K, V any](h Hasher[K]) *PersistentMap[K, V] {
+	return &PersistentMap[K, V]{hasher: h}
+}
+
+// NewPersistentMap create an empty persistent map of Key/Value
+func NewPersistentMap() *PersistentMap[Key, Value] {
+	return NewPersistent[Key, Value](NewKeyHasher())
+}
+
+func (m *PersistentMap[K, V]) Count() int {
+	return m.count
+}
+
+func (m *PersistentMap[K, V]) Find(k *K) *V {
+	if m.root == nil {
+		return nil
+	}
+
+	curr := m.root
+	hash := m.hasher.Hash(*k)
+	shiftBits := uint(0)
+	for {
+		if curr.isLeaf() {
+			if m.hasher.Equal(*curr.key, *k) {
+				return curr.val
+			}
+			return nil
+		}
+
+		if shiftBits >= maxHashBits {
+			for i := range curr.sub {
+				if m.hasher.Equal(*curr.sub[i].key, *k) {
+					return curr.sub[i].val
+				}
+			}
+			return nil
+		}
+
+		symbol := hash & hashSymbolMask
+		if !curr.bitmap.isSet(symbol) {
+			return nil
+		}
+		curr = &curr.sub[curr.bitmap.countBelow(symbol)]
+		shiftBits += symbolWidth
+		hash >>= symbolWidth
+	}
+}
+
+// With return a new map with k mapped to v
+func (m *PersistentMap[K, V]) With(k *K, v *V) *PersistentMap[K, V] {
+	if m.root == nil {
+		return &PersistentMap[K, V]{count: 1, root: &pentry[K, V]{key: k, val: v}, hasher: m.hasher}
+	}
+
+	root, added := m.with(m.root, m.hasher.Hash(*k), 0, k, v)
+	count := m.count
+	if added {
+		count++
+	}
+	return &PersistentMap[K, V]{count: count, root: &root, hasher: m.hasher}
+}
+
+// Without return a new map without k, or m itself if k does not exist
+func (m *PersistentMap[K, V]) Without(k *K) *PersistentMap[K, V] {
+	if m.root == nil {
+		return m
+	}
+
+	root, found, empty := m.without(m.root, m.hasher.Hash(*k), 0, k)
+	if !found {
+		return m
+	}
+	if empty {
+		return &PersistentMap[K, V]{hasher: m.hasher}
+	}
+	return &PersistentMap[K, V]{count: m.count - 1, root: &root, hasher: m.hasher}
+}
+
+// Range call fn for each key/value in map until fn returns false.
+func (m *PersistentMap[K, V]) Range(fn func(k *K, v *V) bool) {
+	if m.root == nil {
+		return
+	}
+	m.root.walk(fn)
+}
+
+// with return copy of e with k mapped to v and whether k is newly added
+func (m *PersistentMap[K, V]) with(e *pentry[K, V], hash uint64, shiftBits uint, k *K, v *V) (pentry[K, V], bool) {
+	if e.isLeaf() {
+		if m.hasher.Equal(*e.key, *k) {
+			return pentry[K, V]{key: e.key, val: v}, false
+		}
+		oldHash := m.hasher.Hash(*e.key) >> shiftBits
+		return m.split(e, hash, oldHash, shiftBits, k, v), true
+	}
+
+	if shiftBits >= maxHashBits {
+		for i := range e.sub {
+			if m.hasher.Equal(*e.sub[i].key, *k) {
+				sub := cloneEntries(e.sub, 0)
+				sub[i].val = v
+				return pentry[K, V]{sub: sub}, false
+			}
+		}
+		sub := cloneEntries(e.sub, 1)
+		sub = append(sub, pentry[K, V]{key: k, val: v})
+		return pentry[K, V]{sub: sub}, true
+	}
+
+	symbol := hash & hashSymbolMask
+	index := e.bitmap.countBelow(symbol)
+	if !e.bitmap.isSet(symbol) {
+		sub := make([]pentry[K, V], len(e.sub)+1)
+		copy(sub, e.sub[:index])
+		sub[index] = pentry[K, V]{key: k, val: v}
+		copy(sub[index+1:], e.sub[index:])
+		return pentry[K, V]{bitmap: e.bitmap.set(symbol), sub: sub}, true
+	}
+
+	child, added := m.with(&e.sub[index], hash>>symbolWidth, shiftBits+symbolWidth, k, v)
+	sub := cloneEntries(e.sub, 0)
+	sub[index] = child
+	return pentry[K, V]{bitmap: e.bitmap, sub: sub}, added
+}
+
+// split build sub-trie holding both leaf and k/v, which is a chain of AMT nodes if their hashes collide
+func (m *PersistentMap[K, V]) split(leaf *pentry[K, V], hash, oldHash uint64, shiftBits uint, k *K, v *V) pentry[K, V] {
+	if shiftBits >= maxHashBits {
+		return pentry[K, V]{sub: []pentry[K, V]{*leaf, {key: k, val: v}}}
+	}
+
+	newSymbol := hash & hashSymbolMask
+	oldSymbol := oldHash & hashSymbolMask
+	if newSymbol == oldSymbol {
+		child := m.split(leaf, hash>>symbolWidth, oldHash>>symbolWidth, shiftBits+symbolWidth, k, v)
+		return pentry[K, V]{bitmap: bitmap(0).set(newSymbol), sub: []pentry[K, V]{child}}
+	}
+
+	sub := []pentry[K, V]{*leaf, {key: k, val: v}}
+	if newSymbol < oldSymbol {
+		sub[0], sub[1] = sub[1], sub[0]
+	}
+	return pentry[K, V]{bitmap: bitmap(0).set(newSymbol).set(oldSymbol), sub: sub}
+}
+
+// without return copy of e without k, whether k is found, and whether the result is empty.
+// Single-child AMT chains ending with a leaf are collapsed to the leaf.
+func (m *PersistentMap[K, V]) without(e *pentry[K, V], hash uint64, shiftBits uint, k *K) (pentry[K, V], bool, bool) {
+	if e.isLeaf() {
+		if m.hasher.Equal(*e.key, *k) {
+			return pentry[K, V]{}, true, true
+		}
+		return *e, false, false
+	}
+
+	if shiftBits >= maxHashBits {
+		for i := range e.sub {
+			if m.hasher.Equal(*e.sub[i].key, *k) {
+				if len(e.sub) == 2 {
+					return e.sub[1-i], true, false
+				}
+				sub := make([]pentry[K, V], 0, len(e.sub)-1)
+				sub = append(sub, e.sub[:i]...)
+				sub = append(sub, e.sub[i+1:]...)
+				return pentry[K, V]{sub: sub}, true, false
+			}
+		}
+		return *e, false, false
+	}
+
+	symbol := hash & hashSymbolMask
+	if !e.bitmap.isSet(symbol) {
+		return *e, false, false
+	}
+	index := e.bitmap.countBelow(symbol)
+	child, found, empty := m.without(&e.sub[index], hash>>symbolWidth, shiftBits+symbolWidth, k)
+	if !found {
+		return *e, false, false
+	}
+
+	if !empty {
+		if len(e.sub) == 1 && child.isLeaf() {
+			return child, true, false
+		}
+		sub := cloneEntries(e.sub, 0)
+		sub[index] = child
+		return pentry[K, V]{bitmap: e.bitmap, sub: sub}, true, false
+	}
+
+	switch len(e.sub) {
+	case 1:
+		return pentry[K, V]{}, true, true
+	case 2:
+		if other := e.sub[1-index]; other.isLeaf() {
+			return other, true, false
+		}
+	}
+	sub := make([]pentry[K, V], 0, len(e.sub)-1)
+	sub = append(sub, e.sub[:index]...)
+	sub = append(sub, e.sub[index+1:]...)
+	return pentry[K, V]{bitmap: e.bitmap.clear(symbol), sub: sub}, true, false
+}
+
+func (e *pentry[K, V]) isLeaf() bool {
+	return e.sub == nil
+}
+
+// walk visit sub-trie depth-first, return false if stopped by fn
+func (e *pentry[K, V]) walk(fn func(k *K, v *V) bool) bool {
+	if e.isLeaf() {
+		return fn(e.key, e.val)
+	}
+	for i := range e.sub {
+		if !e.sub[i].walk(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneEntries copy entry list with room for extra entries
+func cloneEntries[K, V any](entries []pentry[K, V], extra int) []pentry[K, V] {
+	return append(make([]pentry[K, V], 0, len(entries)+extra), entries...)
+}
@@ -0,0 +1,133 @@
+package qfmalloc
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// Checked mode surrounds payload of each block with canary words and poisons payload of freed blocks:
+//   - front canary tells live block from freed one, so that double free is detected
+//   - back canary is overwritten by buffer overflow
+//   - poison of a free block is overwritten by write after free, which is detected on reuse
+//
+// Pointers to be freed are checked against pages and spans of allocator before touching them.
+
+const (
+	canarySize = wordSize
+	liveCanary = uint64(0x5afe5afe5afe5afe)
+	freeCanary = uint64(0xf4eef4eef4eef4ee)
+	poison     = uint64(0xdeadbeefdeadbeef)
+)
+
+func (a *Allocator) frontCanary(b *block) *uint64 {
+	return (*uint64)(unsafe.Pointer(uintptr(unsafe.Pointer(b)) + blockHeaderSize))
+}
+
+func (a *Allocator) backCanary(b *block) *uint64 {
+	return (*uint64)(unsafe.Pointer(uintptr(a.payloadOf(b)) + a.payloadSize(int(b.entryNum))))
+}
+
+// canary of block is xor-ed with block address, so that it's unlikely to be valid at a random address
+func canaryOf(magic uint64, b *block) uint64 {
+	return magic ^ uint64(uintptr(unsafe.Pointer(b)))
+}
+
+// onAlloc set canaries of block to be handed out
+func (a *Allocator) onAlloc(b *block) {
+	if !a.checked {
+		return
+	}
+	*a.frontCanary(b) = canaryOf(liveCanary, b)
+	*a.backCanary(b) = canaryOf(liveCanary, b)
+}
+
+// onFree mark block as freed and poison its payload except freelist links
+func (a *Allocator) onFree(b *block) {
+	if !a.checked {
+		return
+	}
+	*a.frontCanary(b) = canaryOf(freeCanary, b)
+	words := unsafe.Slice((*uint64)(a.payloadOf(b)), a.payloadSize(int(b.entryNum))/wordSize)
+	for i := linkSize / wordSize; i < uintptr(len(words)); i++ {
+		words[i] = poison
+	}
+}
+
+// checkFree panic if p is not payload of a live block of this allocator, or the block is corrupted
+func (a *Allocator) checkFree(p unsafe.Pointer) {
+	if !a.owns(uintptr(p)) {
+		panic(fmt.Sprintf("qfmalloc: free of pointer %p not allocated by this allocator", p))
+	}
+
+	b := a.blockOf(p)
+	switch *a.frontCanary(b) {
+	case canaryOf(liveCanary, b):
+	case canaryOf(freeCanary, b):
+		panic(fmt.Sprintf("qfmalloc: double free of %p", p))
+	default:
+		panic(fmt.Sprintf("qfmalloc: front canary of %p is corrupted (buffer underflow or not start of block)", p))
+	}
+	if *a.backCanary(b) != canaryOf(liveCanary, b) {
+		panic(fmt.Sprintf("qfmalloc: back canary of %p (%d entries) is corrupted (buffer overflow)", p, b.entryNum))
+	}
+}
+
+// checkPoison panic if free block taken from freelist was written after free
+func (a *Allocator) checkPoison(b *block) {
+	if !a.checked {
+		return
+	}
+	p := a.payloadOf(b)
+	if *a.frontCanary(b) != canaryOf(freeCanary, b) {
+		panic(fmt.Sprintf("qfmalloc: front canary of free block %p is corrupted", p))
+	}
+	words := unsafe.Slice((*uint64)(p), a.payloadSize(int(b.entryNum))/wordSize)
+	for i := linkSize / wordSize; i < uintptr(len(words)); i++ {
+		if words[i] != poison {
+			panic(fmt.Sprintf("qfmalloc: write after free detected at %p word %d", p, i))
+		}
+	}
+}
+
+// owns check if addr can be payload of a block of this allocator
+func (a *Allocator) owns(addr uintptr) bool {
+	if addr < a.payloadOffset {
+		return false
+	}
+	if _, ok := a.large[addr-a.payloadOffset]; ok {
+		return true
+	}
+
+	pg := a.pool.pageContaining(addr)
+	if pg == nil {
+		return false
+	}
+	off := addr - pg.base()
+	return off >= a.payloadOffset && off < pg.used && pg.blockAt(off-a.payloadOffset).page == pg.index
+}
+
+// trackPage keep pages sorted by address to look up page containing an address
+func (po *pool) trackPage(pg *page) {
+	i := sort.Search(len(po.byAddr), func(i int) bool { return po.byAddr[i].base() > pg.base() })
+	po.byAddr = append(po.byAddr, nil)
+	copy(po.byAddr[i+1:], po.byAddr[i:])
+	po.byAddr[i] = pg
+}
+
+func (po *pool) untrackPage(pg *page) {
+	i := sort.Search(len(po.byAddr), func(i int) bool { return po.byAddr[i].base() >= pg.base() })
+	po.byAddr = append(po.byAddr[:i], po.byAddr[i+1:]...)
+}
+
+func (po *pool) pageContaining(addr uintptr) *page {
+	i := sort.Search(len(po.byAddr), func(i int) bool { return po.byAddr[i].base() > addr })
+	if i == 0 {
+		return nil
+	}
+	pg := po.byAddr[i-1]
+	if addr >= pg.base()+po.pageSize {
+		return nil
+	}
+	return pg
+}
@@ -1,139 +1,351 @@
 package qfmalloc
 
 import (
+	"math"
 	"unsafe"
 )
 
 // Allocator quick-fit memory allocator for HAMT entry
-// NOTE: it never release memory!
+// Blocks of the same entry number are recycled through freelists, and pages whose blocks are all freed
+// are released to GC.
+// Blocks with more than `maxEntryNum` entries or too big for a page are allocated in dedicated spans.
 type Allocator struct {
 	entrySize uintptr
 	pool      *pool
 	freelists []freelist
+	large     map[uintptr][]uint64 // dedicated spans of large blocks, keyed by block address
+	inUse     uintptr              // payload bytes of live blocks
+
+	// block layout: header | [front canary] | payload | [back canary]
+	payloadOffset uintptr
+	tailSize      uintptr
+	checked       bool
+}
+
+// Option configure Allocator on creation
+type Option func(*options)
+
+type options struct {
+	pageSize uintptr
+	checked  bool
+}
+
+// WithPageSize set size of pages blocks are carved from, default is 4 KiB
+func WithPageSize(size uintptr) Option {
+	return func(o *options) {
+		o.pageSize = size
+	}
 }
 
-func New(entrySize uintptr, maxEntryNum int) *Allocator {
-	return &Allocator{entrySize: entrySize, pool: new(pool), freelists: make([]freelist, maxEntryNum)}
+// WithChecks enable checked mode for debugging, which panics on double free, foreign pointer,
+// buffer overflow and write after free. It costs extra memory and time.
+func WithChecks() Option {
+	return func(o *options) {
+		o.checked = true
+	}
+}
+
+func New(entrySize uintptr, maxEntryNum int, opts ...Option) *Allocator {
+	o := options{pageSize: defaultPageSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.pageSize < minPageSize {
+		o.pageSize = minPageSize
+	}
+
+	a := &Allocator{
+		entrySize:     entrySize,
+		pool:          &pool{pageSize: alignUp(o.pageSize), trackAddr: o.checked},
+		freelists:     make([]freelist, maxEntryNum),
+		large:         make(map[uintptr][]uint64),
+		payloadOffset: blockHeaderSize,
+		checked:       o.checked,
+	}
+	if o.checked {
+		a.payloadOffset += canarySize
+		a.tailSize = canarySize
+	}
+	return a
 }
 
 func (a *Allocator) Alloc(entryNum int) unsafe.Pointer {
+	size := a.blockSize(entryNum)
+	if entryNum > len(a.freelists) || size > a.pool.pageSize {
+		b := a.allocLarge(size, entryNum)
+		a.onAlloc(b)
+		return a.payloadOf(b)
+	}
+
 	fl := a.freelist(entryNum)
+	var b *block
 	if fl.empty() {
-		return a.pool.alloc(a.entrySize, entryNum).payload()
+		b = a.pool.alloc(size, entryNum)
+	} else {
+		b = a.blockOf(fl.remove(a.entrySize * uintptr(entryNum)))
+		a.checkPoison(b)
 	}
-	return fl.remove().payload()
+	a.onAlloc(b)
+	a.pool.pageOf(b).live++
+	a.inUse += a.entrySize * uintptr(entryNum)
+	return a.payloadOf(b)
 }
 
 func (a *Allocator) Free(p unsafe.Pointer) {
-	b := blockOfPayload(p)
-	fl := a.freelist(b.entryNum)
-	fl.add(b)
+	if a.checked {
+		a.checkFree(p)
+	}
+
+	b := a.blockOf(p)
+	a.onFree(b)
+	if b.page == largePage {
+		a.freeLarge(b)
+		return
+	}
+
+	fl := a.freelist(int(b.entryNum))
+	fl.add((*link)(p), a.entrySize*uintptr(b.entryNum))
+	a.inUse -= a.entrySize * uintptr(b.entryNum)
+
+	pg := a.pool.pageOf(b)
+	pg.live--
+	if pg.live == 0 {
+		a.releasePage(pg)
+	}
+}
+
+// allocLarge allocate block in a dedicated span which is released to GC once freed
+func (a *Allocator) allocLarge(size uintptr, entryNum int) *block {
+	span := make([]uint64, size/wordSize)
+	b := (*block)(unsafe.Pointer(&span[0]))
+	b.entryNum = int32(entryNum)
+	b.page = largePage
+	a.large[uintptr(unsafe.Pointer(b))] = span
+	a.inUse += a.entrySize * uintptr(entryNum)
+	return b
+}
+
+func (a *Allocator) freeLarge(b *block) {
+	delete(a.large, uintptr(unsafe.Pointer(b)))
+	a.inUse -= a.entrySize * uintptr(b.entryNum)
+}
+
+// Stats memory usage of allocator
+type Stats struct {
+	Pages         int       // pages currently held
+	PageBytes     uintptr   // bytes of pages currently held
+	LargeSpans    int       // dedicated spans of large blocks currently held
+	LargeBytes    uintptr   // bytes of dedicated spans currently held
+	InUseBytes    uintptr   // payload bytes of live blocks, including large ones
+	FreeBytes     []uintptr // payload bytes on freelist of each size class, indexed by entry number - 1
+	Fragmentation float64   // fraction of page and span bytes not in use
+}
+
+func (a *Allocator) Stats() Stats {
+	s := Stats{
+		Pages:      a.pool.pageNum,
+		PageBytes:  uintptr(a.pool.pageNum) * a.pool.pageSize,
+		LargeSpans: len(a.large),
+		InUseBytes: a.inUse,
+		FreeBytes:  make([]uintptr, len(a.freelists)),
+	}
+	for _, span := range a.large {
+		s.LargeBytes += uintptr(len(span)) * wordSize
+	}
+	for i := range a.freelists {
+		s.FreeBytes[i] = a.freelists[i].bytes
+	}
+	if total := s.PageBytes + s.LargeBytes; total > 0 {
+		s.Fragmentation = 1 - float64(s.InUseBytes)/float64(total)
+	}
+	return s
 }
 
 func (a *Allocator) freelist(entryNum int) *freelist {
 	return &a.freelists[entryNum-1]
 }
 
-type blockptr uintptr
+// payloadSize size of payload holding entryNum entries, with room for freelist links
+func (a *Allocator) payloadSize(entryNum int) uintptr {
+	size := a.entrySize * uintptr(entryNum)
+	if size < linkSize {
+		size = linkSize
+	}
+	return alignUp(size)
+}
+
+// blockSize size of block holding entryNum entries, including header and canaries
+func (a *Allocator) blockSize(entryNum int) uintptr {
+	return a.payloadOffset + a.payloadSize(entryNum) + a.tailSize
+}
+
+func (a *Allocator) payloadOf(b *block) unsafe.Pointer {
+	return unsafe.Pointer(uintptr(unsafe.Pointer(b)) + a.payloadOffset)
+}
+
+func (a *Allocator) blockOf(p unsafe.Pointer) *block {
+	return (*block)(unsafe.Pointer(uintptr(p) - a.payloadOffset))
+}
+
+// releasePage unlink all (free) blocks of page from freelists, then release page to GC.
+// The current page of pool is kept and reused from its beginning.
+func (a *Allocator) releasePage(pg *page) {
+	for off := uintptr(0); off < pg.used; {
+		b := pg.blockAt(off)
+		a.freelist(int(b.entryNum)).unlink((*link)(a.payloadOf(b)), a.entrySize*uintptr(b.entryNum))
+		off += a.blockSize(int(b.entryNum))
+	}
 
-func (bp blockptr) ptr() *block {
-	return (*block)(unsafe.Pointer(bp))
+	if pg == a.pool.currPage {
+		pg.used = 0
+		return
+	}
+	a.pool.release(pg)
 }
 
+// block header of allocated entries
 type block struct {
-	entryNum int
-	next     blockptr
+	entryNum int32
+	page     uint32 // index of page in pool, or `largePage` for block in dedicated span
 }
 
 const (
-	blockPayloadOffset = unsafe.Offsetof(block{}.next)
+	blockHeaderSize = unsafe.Sizeof(block{})
+	wordSize        = unsafe.Sizeof(uint64(0))
 )
 
-func (b *block) payload() unsafe.Pointer {
-	return unsafe.Pointer(uintptr(unsafe.Pointer(b)) + blockPayloadOffset)
-}
-
-func blockOfPayload(p unsafe.Pointer) *block {
-	return (*block)(unsafe.Pointer(uintptr(p) - blockPayloadOffset))
+func alignUp(size uintptr) uintptr {
+	return (size + wordSize - 1) &^ (wordSize - 1)
 }
 
 const (
-	pageSize          = 4096
-	pagePayloadOffset = unsafe.Offsetof(struct {
-		next    unsafe.Pointer
-		payload int
-	}{}.payload)
-	pagePayloadSize = pageSize - pagePayloadOffset
+	defaultPageSize = 4096
+	minPageSize     = 64
+	largePage       = math.MaxUint32
 )
 
+// page memory blocks are carved from, `mem` is word slice to keep blocks aligned
 type page struct {
-	next     *page
-	_payload [pagePayloadSize]byte
+	mem   []uint64
+	index uint32
+	live  int     // number of live blocks
+	used  uintptr // bytes carved from beginning of mem
+}
+
+func (pg *page) base() uintptr {
+	return uintptr(unsafe.Pointer(&pg.mem[0]))
+}
+
+func (pg *page) blockAt(off uintptr) *block {
+	return (*block)(unsafe.Pointer(pg.base() + off))
 }
 
 // pool memory pool for entry allocation
-// TODO: this pool never release memory
 type pool struct {
-	currPage *page
-	free     blockptr
+	pageSize  uintptr
+	pages     []*page  // all pages indexed by `page.index`, nil for released ones
+	freeIndex []uint32 // indexes of released pages to be reused
+	pageNum   int
+	currPage  *page
+
+	// pages sorted by address, only tracked in checked mode
+	trackAddr bool
+	byAddr    []*page
 }
 
-// TODO: entries to be allocated cannot fit in a single page?
-func (po *pool) alloc(entrySize uintptr, entryNum int) *block {
-	if po.free == blockptr(0) || po.free.ptr().entryNum < entryNum {
-		p, payload := po.newPage(entrySize)
-		p.next = po.currPage
-		po.currPage = p
-		po.free = payload
+func (po *pool) alloc(size uintptr, entryNum int) *block {
+	if po.currPage == nil || po.currPage.used+size > po.pageSize {
+		po.currPage = po.newPage()
 	}
 
-	currBlk := po.free
-	//currNum := currBlk.ptr().entryNum
-	currBlk.ptr().entryNum = entryNum
-
-	nextBlk := blockptr(uintptr(currBlk) + blockPayloadOffset + entrySize*uintptr(entryNum))
-	pageEnd := uintptr(unsafe.Pointer(po.currPage)) + pageSize
-	nextNum := int(pageEnd-uintptr(nextBlk)-blockPayloadOffset) / int(entrySize)
+	pg := po.currPage
+	b := pg.blockAt(pg.used)
+	b.entryNum = int32(entryNum)
+	b.page = pg.index
+	pg.used += size
+	return b
+}
 
-	//fmt.Printf("  - alloc: page=%p need=%d have=%d remain=%d curr=%p next=%p\n", po.currPage, entryNum, currNum, nextNum, currBlk.ptr(), nextBlk.ptr())
+func (po *pool) newPage() *page {
+	pg := &page{mem: make([]uint64, po.pageSize/wordSize)}
+	if n := len(po.freeIndex); n > 0 {
+		pg.index = po.freeIndex[n-1]
+		po.freeIndex = po.freeIndex[:n-1]
+		po.pages[pg.index] = pg
+	} else {
+		pg.index = uint32(len(po.pages))
+		po.pages = append(po.pages, pg)
+	}
+	po.pageNum++
+	if po.trackAddr {
+		po.trackPage(pg)
+	}
+	return pg
+}
 
-	// allocate new page when no enough space for another block
-	if nextNum <= 0 {
-		p, payload := po.newPage(entrySize)
-		//fmt.Printf("    - alloc new page: %p\n", p)
-		p.next = po.currPage
-		po.currPage = p
-		po.free = payload
-		return currBlk.ptr()
+func (po *pool) release(pg *page) {
+	po.pages[pg.index] = nil
+	po.freeIndex = append(po.freeIndex, pg.index)
+	po.pageNum--
+	if po.trackAddr {
+		po.untrackPage(pg)
 	}
+}
+
+func (po *pool) pageOf(b *block) *page {
+	return po.pages[b.page]
+}
+
+type linkptr uintptr
 
-	nextBlk.ptr().entryNum = nextNum
-	po.free = nextBlk
-	return currBlk.ptr()
+func (lp linkptr) ptr() *link {
+	return (*link)(unsafe.Pointer(lp))
 }
 
-func (po *pool) newPage(entrySize uintptr) (*page, blockptr) {
-	p := new(page)
-	payload := blockptr(unsafe.Pointer(&p._payload))
-	payload.ptr().entryNum = int(pagePayloadSize / entrySize)
-	return p, payload
+// link freelist links stored in payload of free block
+type link struct {
+	next linkptr
+	prev linkptr
 }
 
+const (
+	linkSize = unsafe.Sizeof(link{})
+)
+
+// freelist doubly linked list of free blocks of the same entry number
 type freelist struct {
-	_head blockptr
+	_head linkptr
+	bytes uintptr // payload bytes of blocks in list
 }
 
 func (fl *freelist) empty() bool {
-	return fl._head == blockptr(0)
+	return fl._head == linkptr(0)
 }
 
-func (fl freelist) add(b *block) {
-	b.next = fl._head
-	fl._head = blockptr(unsafe.Pointer(b))
+func (fl *freelist) add(l *link, bytes uintptr) {
+	l.next = fl._head
+	l.prev = linkptr(0)
+	if !fl.empty() {
+		fl._head.ptr().prev = linkptr(unsafe.Pointer(l))
+	}
+	fl._head = linkptr(unsafe.Pointer(l))
+	fl.bytes += bytes
 }
 
-func (fl *freelist) remove() *block {
-	b := fl._head.ptr()
-	fl._head = b.next
-	return b
+func (fl *freelist) remove(bytes uintptr) unsafe.Pointer {
+	l := fl._head.ptr()
+	fl.unlink(l, bytes)
+	return unsafe.Pointer(l)
+}
+
+func (fl *freelist) unlink(l *link, bytes uintptr) {
+	if l.prev == linkptr(0) {
+		fl._head = l.next
+	} else {
+		l.prev.ptr().next = l.next
+	}
+	if l.next != linkptr(0) {
+		l.next.ptr().prev = l.prev
+	}
+	fl.bytes -= bytes
 }
@@ -1,9 +1,12 @@
 package qfmalloc
 
 import (
+	"fmt"
 	"math/rand"
 	"testing"
 	"unsafe"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestAllocator(t *testing.T) {
@@ -22,3 +25,146 @@ func TestAllocator(t *testing.T) {
 		allocator.Free(unsafe.Pointer(ptr))
 	}
 }
+
+func TestAllocator_Stats(t *testing.T) {
+	allocator := New(16, 32)
+	var ptrs []unsafe.Pointer
+	var nums []int
+	for i := 0; i < 100000; i++ {
+		entryNum := int(rand.Int63n(32)) + 1
+		ptr := allocator.Alloc(entryNum)
+		// fill payload to detect overlapped blocks
+		payload := unsafe.Slice((*uint64)(ptr), entryNum*2)
+		for j := range payload {
+			payload[j] = uint64(i)
+		}
+		ptrs = append(ptrs, ptr)
+		nums = append(nums, entryNum)
+	}
+
+	s := allocator.Stats()
+	inUse := uintptr(0)
+	for _, n := range nums {
+		inUse += uintptr(n) * 16
+	}
+	assert.Equal(t, inUse, s.InUseBytes)
+	assert.True(t, s.Pages > 0)
+	assert.True(t, s.Fragmentation >= 0 && s.Fragmentation < 1)
+
+	// free every other block
+	for i := 0; i < len(ptrs); i += 2 {
+		allocator.Free(ptrs[i])
+		inUse -= uintptr(nums[i]) * 16
+	}
+	s = allocator.Stats()
+	assert.Equal(t, inUse, s.InUseBytes)
+	freeBytes := uintptr(0)
+	for _, b := range s.FreeBytes {
+		freeBytes += b
+	}
+	assert.True(t, freeBytes > 0)
+
+	for i := 1; i < len(ptrs); i += 2 {
+		payload := unsafe.Slice((*uint64)(ptrs[i]), nums[i]*2)
+		for j := range payload {
+			assert.Equal(t, uint64(i), payload[j])
+		}
+		allocator.Free(ptrs[i])
+	}
+
+	// only current page is kept after all blocks are freed
+	s = allocator.Stats()
+	assert.Equal(t, 1, s.Pages)
+	assert.Equal(t, uintptr(0), s.InUseBytes)
+	for _, b := range s.FreeBytes {
+		assert.Equal(t, uintptr(0), b)
+	}
+}
+
+func TestAllocator_Large(t *testing.T) {
+	allocator := New(16, 8, WithPageSize(256))
+
+	var ptrs []unsafe.Pointer
+	for entryNum := 1; entryNum <= 64; entryNum++ {
+		ptr := allocator.Alloc(entryNum)
+		payload := unsafe.Slice((*uint64)(ptr), entryNum*2)
+		for j := range payload {
+			payload[j] = uint64(entryNum)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+
+	s := allocator.Stats()
+	// entries > 8 do not fit in freelists
+	assert.Equal(t, 64-8, s.LargeSpans)
+	assert.True(t, s.Pages > 0)
+	for _, b := range s.FreeBytes {
+		assert.Equal(t, uintptr(0), b)
+	}
+
+	for i, ptr := range ptrs {
+		entryNum := i + 1
+		payload := unsafe.Slice((*uint64)(ptr), entryNum*2)
+		for j := range payload {
+			assert.Equal(t, uint64(entryNum), payload[j])
+		}
+		allocator.Free(ptr)
+	}
+
+	s = allocator.Stats()
+	assert.Equal(t, 0, s.LargeSpans)
+	assert.Equal(t, uintptr(0), s.LargeBytes)
+	assert.Equal(t, uintptr(0), s.InUseBytes)
+}
+
+func TestAllocator_Checked(t *testing.T) {
+	allocator := New(16, 32, WithChecks())
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 100000; i++ {
+		entryNum := int(rand.Int63n(40)) + 1
+		ptr := allocator.Alloc(entryNum)
+		payload := unsafe.Slice((*uint64)(ptr), entryNum*2)
+		for j := range payload {
+			payload[j] = uint64(i)
+		}
+		ptrs = append(ptrs, ptr)
+		if rand.Intn(3) == 0 {
+			k := rand.Intn(len(ptrs))
+			allocator.Free(ptrs[k])
+			ptrs[k] = ptrs[len(ptrs)-1]
+			ptrs = ptrs[:len(ptrs)-1]
+		}
+	}
+	for _, ptr := range ptrs {
+		allocator.Free(ptr)
+	}
+	assert.Equal(t, uintptr(0), allocator.Stats().InUseBytes)
+
+	// double free
+	p1 := allocator.Alloc(2)
+	allocator.Alloc(2) // keep page alive
+	allocator.Free(p1)
+	assert.PanicsWithValue(t, fmt.Sprintf("qfmalloc: double free of %p", p1), func() { allocator.Free(p1) })
+
+	// foreign pointer
+	var x [4]uint64
+	assert.Panics(t, func() { allocator.Free(unsafe.Pointer(&x[2])) })
+	p2 := allocator.Alloc(2)
+	assert.Panics(t, func() { allocator.Free(unsafe.Add(p2, 8)) })
+
+	// buffer overflow
+	payload := unsafe.Slice((*uint64)(p2), 5)
+	payload[4] = 42
+	assert.Panics(t, func() { allocator.Free(p2) })
+
+	// write after free
+	p3 := allocator.Alloc(3)
+	allocator.Free(p3)
+	*(*uint64)(unsafe.Add(p3, 24)) = 42
+	assert.Panics(t, func() { allocator.Alloc(3) })
+
+	// large block
+	p4 := allocator.Alloc(100)
+	allocator.Free(p4)
+	assert.Panics(t, func() { allocator.Free(p4) })
+}
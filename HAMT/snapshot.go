@@ -0,0 +1,225 @@
+package hamt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshot format written by `Map.WriteTo`, all integers are little endian:
+//
+//	magic    [4]byte "HAMT"
+//	version  uint16
+//	keySize  uint32  encoded size of a key
+//	valSize  uint32  encoded size of a value
+//	count    uint64  number of key/value pairs
+//	pairs    count * (key, flag, value) in the order of `Map.Range`
+//	checksum uint32  CRC-32C of all preceding bytes
+//
+// Keys and values are encoded by encoding/binary, so they must be of fixed size, e.g. Key/Value, numbers,
+// and arrays or structs of them. Flag byte is 1 if key has a value, or 0 if its value is nil, which is
+// then encoded as zero bytes.
+
+const (
+	snapshotMagic    = "HAMT"
+	snapshotVersion  = 1
+	snapshotHeadSize = len(snapshotMagic) + 2 + 4 + 4 + 8
+	snapshotBatch    = 64 << 10 // bytes of pairs buffered for each read/write
+)
+
+var (
+	ErrSnapshotCorrupted = errors.New("hamt: corrupted snapshot")
+	ErrSnapshotVersion   = errors.New("hamt: unsupported snapshot version")
+	ErrNotFixedSize      = errors.New("hamt: key or value is not of fixed size")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteTo write snapshot of map to w, implements io.WriterTo
+func (m *Map[K, V]) WriteTo(w io.Writer) (int64, error) {
+	keySize, valSize, err := fixedSizes[K, V]()
+	if err != nil {
+		return 0, err
+	}
+
+	sw := &snapshotWriter{w: w, crc: crc32.New(crcTable)}
+	buf := make([]byte, 0, snapshotHeadSize+snapshotBatch)
+	buf = append(buf, snapshotMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, snapshotVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(keySize))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(valSize))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(m.count))
+
+	m.Range(func(k *K, v *V) bool {
+		if buf, err = appendPair(buf, k, v, valSize); err != nil {
+			sw.err = err
+			return false
+		}
+		if len(buf) >= snapshotBatch {
+			sw.write(buf)
+			buf = buf[:0]
+		}
+		return sw.err == nil
+	})
+	sw.write(buf)
+	sw.write(binary.LittleEndian.AppendUint32(nil, sw.crc.Sum32()))
+	return sw.n, sw.err
+}
+
+// ReadFrom read snapshot written by `Map.WriteTo` from r, and return map of Key/Value which owns its keys/values
+func ReadFrom(r io.Reader) (*Map[Key, Value], error) {
+	return Load[Key, Value](r, NewKeyHasher())
+}
+
+// Load read snapshot written by `Map.WriteTo` from r into a new map using hasher h.
+// The map owns its keys/values as if created with `WithOwnedStorage`.
+// Exactly the bytes of snapshot are read from r.
+func Load[K, V any](r io.Reader, h Hasher[K]) (*Map[K, V], error) {
+	keySize, valSize, err := fixedSizes[K, V]()
+	if err != nil {
+		return nil, err
+	}
+
+	crc := crc32.New(crcTable)
+	tr := io.TeeReader(r, crc)
+
+	head := make([]byte, snapshotHeadSize)
+	if _, err := io.ReadFull(tr, head); err != nil {
+		return nil, snapshotReadErr(err)
+	}
+	if string(head[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrSnapshotCorrupted)
+	}
+	head = head[len(snapshotMagic):]
+	if version := binary.LittleEndian.Uint16(head); version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, version)
+	}
+	ks, vs := binary.LittleEndian.Uint32(head[2:]), binary.LittleEndian.Uint32(head[6:])
+	if int(ks) != keySize || int(vs) != valSize {
+		return nil, fmt.Errorf("%w: key/value size is %d/%d, expect %d/%d",
+			ErrSnapshotCorrupted, ks, vs, keySize, valSize)
+	}
+	count := binary.LittleEndian.Uint64(head[10:])
+
+	m := New[K, V](h, WithOwnedStorage())
+	pairSize := keySize + 1 + valSize
+	batch := uint64(max(snapshotBatch/max(pairSize, 1), 1))
+	buf := make([]byte, pairSize*int(min(count, batch)))
+	var (
+		k K
+		v V
+	)
+	for remaining := count; remaining > 0; {
+		n := min(remaining, batch)
+		b := buf[:pairSize*int(n)]
+		if _, err := io.ReadFull(tr, b); err != nil {
+			return nil, snapshotReadErr(err)
+		}
+		for i := 0; i < int(n); i++ {
+			pair := b[i*pairSize : (i+1)*pairSize]
+			decodeFixed(pair[:keySize], &k)
+			switch pair[keySize] {
+			case 0:
+				m.Add(&k, nil)
+			case 1:
+				decodeFixed(pair[keySize+1:], &v)
+				m.Add(&k, &v)
+			default:
+				return nil, fmt.Errorf("%w: bad value flag", ErrSnapshotCorrupted)
+			}
+		}
+		remaining -= n
+	}
+
+	// checksum itself is read from r directly
+	sum := crc.Sum32()
+	var tail [4]byte
+	if _, err := io.ReadFull(r, tail[:]); err != nil {
+		return nil, snapshotReadErr(err)
+	}
+	if binary.LittleEndian.Uint32(tail[:]) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupted)
+	}
+	if uint64(m.count) != count {
+		return nil, fmt.Errorf("%w: duplicate keys", ErrSnapshotCorrupted)
+	}
+	return m, nil
+}
+
+// fixedSizes encoded sizes of key and value
+func fixedSizes[K, V any]() (int, int, error) {
+	var (
+		k K
+		v V
+	)
+	keySize, valSize := binary.Size(k), binary.Size(v)
+	if keySize < 0 || valSize < 0 {
+		return 0, 0, ErrNotFixedSize
+	}
+	return keySize, valSize, nil
+}
+
+func snapshotReadErr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrSnapshotCorrupted)
+	}
+	return err
+}
+
+// snapshotWriter keep checksum and number of bytes written, and stop writing on the first error
+type snapshotWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int64
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	sw.crc.Write(p)
+	n, err := sw.w.Write(p)
+	sw.n += int64(n)
+	sw.err = err
+}
+
+// appendPair append encoding of key, flag and value of valSize bytes, see snapshot format
+func appendPair[K, V any](buf []byte, k *K, v *V, valSize int) ([]byte, error) {
+	buf, err := appendFixed(buf, k)
+	if err != nil {
+		return buf, err
+	}
+	if v == nil {
+		buf = append(buf, 0)
+		return append(buf, make([]byte, valSize)...), nil
+	}
+	return appendFixed(append(buf, 1), v)
+}
+
+// appendFixed append encoding of fixed-size data pointed by p, Key/Value skip reflection of encoding/binary
+func appendFixed(buf []byte, p any) ([]byte, error) {
+	switch p := p.(type) {
+	case *Key:
+		return binary.LittleEndian.AppendUint64(buf, uint64(*p)), nil
+	case *Value:
+		return binary.LittleEndian.AppendUint64(buf, uint64(*p)), nil
+	}
+	return binary.Append(buf, binary.LittleEndian, p)
+}
+
+// decodeFixed decode b into fixed-size data pointed by p, see appendFixed
+func decodeFixed(b []byte, p any) {
+	switch p := p.(type) {
+	case *Key:
+		*p = Key(binary.LittleEndian.Uint64(b))
+		return
+	case *Value:
+		*p = Value(binary.LittleEndian.Uint64(b))
+		return
+	}
+	binary.Decode(b, binary.LittleEndian, p)
+}
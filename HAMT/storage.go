@@ -0,0 +1,62 @@
+package hamt
+
+import (
+	"unsafe"
+)
+
+const (
+	slotChunkSize = 256
+)
+
+// slot copy of key/value owned by map
+type slot[K, V any] struct {
+	key K
+	val V
+}
+
+// slotOf get slot from pointer of its key
+func slotOf[K, V any](k *K) *slot[K, V] {
+	return (*slot[K, V])(unsafe.Pointer(k))
+}
+
+// slotStore storage of keys/values owned by map.
+// Unlike entries allocated by qfmalloc, slots live in ordinary Go memory reachable from map,
+// so GC can see both the slots and anything keys/values point to.
+type slotStore[K, V any] struct {
+	chunks [][]slot[K, V]
+	free   []*slot[K, V]
+}
+
+// own copy key/value into a slot and return pointers to the copies, nil value is kept as nil
+func (s *slotStore[K, V]) own(k *K, v *V) (*K, *V) {
+	sl := s.alloc()
+	sl.key = *k
+	if v == nil {
+		return &sl.key, nil
+	}
+	sl.val = *v
+	return &sl.key, &sl.val
+}
+
+func (s *slotStore[K, V]) alloc() *slot[K, V] {
+	if n := len(s.free); n > 0 {
+		sl := s.free[n-1]
+		s.free = s.free[:n-1]
+		return sl
+	}
+
+	n := len(s.chunks)
+	if n == 0 || len(s.chunks[n-1]) == cap(s.chunks[n-1]) {
+		s.chunks = append(s.chunks, make([]slot[K, V], 0, slotChunkSize))
+		n++
+	}
+	chunk := s.chunks[n-1]
+	s.chunks[n-1] = chunk[:len(chunk)+1]
+	return &s.chunks[n-1][len(chunk)]
+}
+
+// release zero slot so that GC can collect what it points to, and recycle it
+func (s *slotStore[K, V]) release(sl *slot[K, V]) {
+	*sl = slot[K, V]{}
+	s.free = append(s.free, sl)
+}
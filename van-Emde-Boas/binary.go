@@ -0,0 +1,103 @@
+package vEB
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Binary format of Tree, all integers are unsigned varints unless noted:
+//
+//	magic   [3]byte "vEB"
+//	version byte
+//	bits    byte    width of universe
+//	store   byte    ClusterStore
+//	count           number of elements
+//	elements        first element, then delta to previous element of the rest
+//
+// The layout of a tree is determined by its elements, so it's rebuilt exactly from them.
+
+const (
+	binaryMagic    = "vEB"
+	binaryVersion  = 1
+	binaryHeadSize = len(binaryMagic) + 3
+)
+
+var (
+	ErrCorrupted  = errors.New("vEB: corrupted binary data")
+	ErrBadVersion = errors.New("vEB: unsupported binary version")
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (t *Tree) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, binaryHeadSize+binary.MaxVarintLen64*(1+min(t.count, 1<<10)))
+	buf = append(buf, binaryMagic...)
+	buf = append(buf, binaryVersion, t.bits, byte(t.store))
+	buf = binary.AppendUvarint(buf, uint64(t.count))
+
+	prev := uint64(0)
+	ascend(t.root, t.bits, 0, 0, universeMax(t.bits), func(x uint64, _ struct{}) bool {
+		buf = binary.AppendUvarint(buf, x-prev)
+		prev = x
+		return true
+	})
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, t is replaced with the decoded tree
+func (t *Tree) UnmarshalBinary(data []byte) error {
+	if len(data) < binaryHeadSize || string(data[:len(binaryMagic)]) != binaryMagic {
+		return fmt.Errorf("%w: bad header", ErrCorrupted)
+	}
+	data = data[len(binaryMagic):]
+	if data[0] != binaryVersion {
+		return fmt.Errorf("%w: %d", ErrBadVersion, data[0])
+	}
+	w, store := data[1], ClusterStore(data[2])
+	if w == 0 || w > maxBits {
+		return fmt.Errorf("%w: invalid universe width %d", ErrCorrupted, w)
+	}
+	if store != ClusterMap && store != ClusterHash {
+		return fmt.Errorf("%w: invalid cluster store %d", ErrCorrupted, store)
+	}
+	data = data[3:]
+
+	count, n := binary.Uvarint(data)
+	// every element takes at least one byte
+	if n <= 0 || count > uint64(len(data)-n) {
+		return fmt.Errorf("%w: invalid count", ErrCorrupted)
+	}
+	data = data[n:]
+
+	keys := make([]uint64, count)
+	for i := range keys {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: truncated elements", ErrCorrupted)
+		}
+		data = data[n:]
+
+		if i == 0 {
+			keys[i] = delta
+		} else {
+			keys[i] = keys[i-1] + delta
+			if delta == 0 || keys[i] < keys[i-1] {
+				return fmt.Errorf("%w: elements not ascending", ErrCorrupted)
+			}
+		}
+		if !inUniverse(keys[i], w) {
+			return fmt.Errorf("%w: element out of universe", ErrCorrupted)
+		}
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("%w: trailing bytes", ErrCorrupted)
+	}
+
+	*t = Tree{
+		root:  buildTree(keys, w, store, true),
+		count: len(keys),
+		bits:  w,
+		store: store,
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package vEB
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+const (
+	// parallelMinKeys min number of keys of a node to build its clusters in parallel
+	parallelMinKeys = 1 << 14
+)
+
+// BuildFromSorted create tree with 64 bits universe holding keys, which must be sorted in ascending order.
+// Duplicate keys are allowed. Clusters and summaries are built bottom-up in one pass, and clusters of the
+// first level that has more than one cluster are built in parallel.
+func BuildFromSorted(keys []uint64, opts ...Option) *Tree {
+	o := newOptions(maxBits, opts)
+	keys = dedupSorted(keys)
+	return &Tree{
+		root:  buildTree(keys, maxBits, o.store, true),
+		count: len(keys),
+		bits:  maxBits,
+		store: o.store,
+	}
+}
+
+// dedupSorted return keys without duplicates, keys is copied only if it has duplicates.
+// Panic if keys is not sorted.
+func dedupSorted(keys []uint64) []uint64 {
+	for i := 1; i < len(keys); i++ {
+		if keys[i] < keys[i-1] {
+			panic("vEB: keys are not sorted")
+		}
+		if keys[i] == keys[i-1] {
+			out := append(make([]uint64, 0, len(keys)-1), keys[:i]...)
+			for _, k := range keys[i+1:] {
+				if k < out[len(out)-1] {
+					panic("vEB: keys are not sorted")
+				}
+				if k != out[len(out)-1] {
+					out = append(out, k)
+				}
+			}
+			return out
+		}
+	}
+	return keys
+}
+
+// buildTree create node of tree holding sorted unique keys in universe of bits width, nil if keys is empty
+func buildTree(keys []uint64, bits uint8, store ClusterStore, parallel bool) *node[struct{}] {
+	return build(keys, make([]struct{}, len(keys)), bits, store, parallel, unitWeight)
+}
+
+// build create node holding sorted unique keys and their values in universe of bits width, nil if keys is empty
+func build[V any](keys []uint64, vals []V, bits uint8, store ClusterStore, parallel bool, w weigher[V]) *node[V] {
+	if len(keys) == 0 {
+		return nil
+	}
+	if isLeaf(bits) {
+		return buildLeaf(keys, vals, w)
+	}
+
+	last := len(keys) - 1
+	n := newNode(keys[0], vals[0], w)
+	if last == 0 {
+		return n
+	}
+	n.max, n.maxVal = keys[last], vals[last]
+	n.count += w(vals[last])
+	if last == 1 {
+		return n
+	}
+
+	// min/max are not stored recursively, group the rest by cluster
+	rest, restVals := keys[1:last], vals[1:last]
+	lows := make([]uint64, len(rest))
+	var (
+		indexes []uint64
+		runs    []run[V]
+	)
+	for start := 0; start < len(rest); {
+		c, _ := split(rest[start], bits)
+		end := start
+		for ; end < len(rest); end++ {
+			cc, i := split(rest[end], bits)
+			if cc != c {
+				break
+			}
+			lows[end] = i
+		}
+		indexes = append(indexes, c)
+		runs = append(runs, run[V]{lows[start:end], restVals[start:end]})
+		start = end
+	}
+
+	clusters := make([]*node[V], len(runs))
+	switch {
+	case parallel && len(runs) == 1:
+		// no fanout yet, try next level
+		clusters[0] = build(runs[0].keys, runs[0].vals, lowBits(bits), store, true, w)
+	case parallel && len(rest) >= parallelMinKeys:
+		buildParallel(runs, clusters, lowBits(bits), store, w)
+	default:
+		for j, r := range runs {
+			clusters[j] = build(r.keys, r.vals, lowBits(bits), store, false, w)
+		}
+	}
+
+	// summary holds weights of clusters
+	weights := make([]int, len(clusters))
+	for j, cluster := range clusters {
+		weights[j] = cluster.count
+		n.count += cluster.count
+	}
+	n.summary = build(indexes, weights, highBits(bits), store, false, clusterWeight)
+	n.clusters = newClusterTable[V](highBits(bits), store)
+	for j, c := range indexes {
+		n.clusters.set(c, clusters[j])
+	}
+	return n
+}
+
+// run keys of a cluster and their values
+type run[V any] struct {
+	keys []uint64
+	vals []V
+}
+
+// buildParallel build clusters from runs of keys, runs are split into contiguous chunks of similar key number
+func buildParallel[V any](runs []run[V], clusters []*node[V], bits uint8, store ClusterStore, w weigher[V]) {
+	total := 0
+	for _, r := range runs {
+		total += len(r.keys)
+	}
+	workers := runtime.GOMAXPROCS(0)
+	chunk := (total + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(runs); {
+		end, size := start, 0
+		for end < len(runs) && (size < chunk || end == start) {
+			size += len(runs[end].keys)
+			end++
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for j := start; j < end; j++ {
+				clusters[j] = build(runs[j].keys, runs[j].vals, bits, store, false, w)
+			}
+		}(start, end)
+		start = end
+	}
+	wg.Wait()
+}
+
+func buildLeaf[V any](keys []uint64, vals []V, w weigher[V]) *node[V] {
+	n := &node[V]{vals: new([64]V)}
+	for j, x := range keys {
+		n.mask |= 1 << x
+		n.vals[x] = vals[j]
+		n.count += w(vals[j])
+	}
+	n.min = uint64(bits.TrailingZeros64(n.mask))
+	n.max = uint64(63 - bits.LeadingZeros64(n.mask))
+	return n
+}
+
+// buildLeafMask create leaf of tree holding elements of non-zero mask
+func buildLeafMask(m uint64) *node[struct{}] {
+	return &node[struct{}]{
+		min:   uint64(bits.TrailingZeros64(m)),
+		max:   uint64(63 - bits.LeadingZeros64(m)),
+		count: bits.OnesCount64(m),
+		mask:  m,
+		vals:  new([64]struct{}),
+	}
+}
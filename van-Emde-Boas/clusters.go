@@ -0,0 +1,191 @@
+package vEB
+
+import (
+	"math/bits"
+)
+
+const (
+	// denseMaxBits max width of cluster index for which clusters are stored in a dense slice
+	denseMaxBits = 8
+)
+
+// ClusterStore how clusters of large levels are stored, levels with small universe always use dense slices
+type ClusterStore int
+
+const (
+	// ClusterMap store clusters in Go map
+	ClusterMap ClusterStore = iota
+	// ClusterHash store clusters in open-addressing hash table, which is faster to look up than Go map
+	ClusterHash
+)
+
+// clusterTable maps cluster index to non-empty cluster
+type clusterTable[V any] interface {
+	get(c uint64) *node[V]
+	set(c uint64, n *node[V])
+	remove(c uint64)
+	// each iterate clusters in no particular order
+	each(fn func(c uint64, n *node[V]))
+}
+
+// newClusterTable create cluster table for cluster index of indexBits width
+func newClusterTable[V any](indexBits uint8, store ClusterStore) clusterTable[V] {
+	if indexBits <= denseMaxBits {
+		return make(denseClusters[V], 1<<indexBits)
+	}
+	if store == ClusterHash {
+		return newHashClusters[V]()
+	}
+	return make(mapClusters[V])
+}
+
+// denseClusters slice indexed by cluster index, for small universe
+type denseClusters[V any] []*node[V]
+
+func (d denseClusters[V]) get(c uint64) *node[V] {
+	return d[c]
+}
+
+func (d denseClusters[V]) set(c uint64, n *node[V]) {
+	d[c] = n
+}
+
+func (d denseClusters[V]) remove(c uint64) {
+	d[c] = nil
+}
+
+func (d denseClusters[V]) each(fn func(c uint64, n *node[V])) {
+	for c, n := range d {
+		if n != nil {
+			fn(uint64(c), n)
+		}
+	}
+}
+
+// mapClusters hash map of clusters, for sparse large universe
+type mapClusters[V any] map[uint64]*node[V]
+
+func (m mapClusters[V]) get(c uint64) *node[V] {
+	return m[c]
+}
+
+func (m mapClusters[V]) set(c uint64, n *node[V]) {
+	m[c] = n
+}
+
+func (m mapClusters[V]) remove(c uint64) {
+	delete(m, c)
+}
+
+func (m mapClusters[V]) each(fn func(c uint64, n *node[V])) {
+	for c, n := range m {
+		fn(c, n)
+	}
+}
+
+const (
+	hashMinCap     = 8
+	hashLoadFactor = 0.75
+	fibonacciMul   = 0x9E3779B97F4A7C15
+)
+
+// hashClusters open-addressing hash table with linear probing, for sparse large universe
+type hashClusters[V any] struct {
+	slots []hashSlot[V]
+	count int
+	shift uint8 // 64 - log2(len(slots))
+}
+
+// hashSlot slot of hash table, which is empty if n is nil
+type hashSlot[V any] struct {
+	c uint64
+	n *node[V]
+}
+
+func newHashClusters[V any]() *hashClusters[V] {
+	return &hashClusters[V]{slots: make([]hashSlot[V], hashMinCap), shift: 64 - uint8(bits.TrailingZeros(hashMinCap))}
+}
+
+// home slot of cluster index by fibonacci hashing
+func (h *hashClusters[V]) home(c uint64) int {
+	return int((c * fibonacciMul) >> h.shift)
+}
+
+func (h *hashClusters[V]) mask() int {
+	return len(h.slots) - 1
+}
+
+func (h *hashClusters[V]) get(c uint64) *node[V] {
+	for i := h.home(c); ; i = (i + 1) & h.mask() {
+		s := &h.slots[i]
+		if s.n == nil {
+			return nil
+		}
+		if s.c == c {
+			return s.n
+		}
+	}
+}
+
+func (h *hashClusters[V]) set(c uint64, n *node[V]) {
+	if float64(h.count+1) > hashLoadFactor*float64(len(h.slots)) {
+		h.resize(len(h.slots) * 2)
+	}
+	for i := h.home(c); ; i = (i + 1) & h.mask() {
+		s := &h.slots[i]
+		if s.n == nil {
+			*s = hashSlot[V]{c: c, n: n}
+			h.count++
+			return
+		}
+		if s.c == c {
+			s.n = n
+			return
+		}
+	}
+}
+
+// remove delete cluster with backward shift, so that no tombstone is needed
+func (h *hashClusters[V]) remove(c uint64) {
+	i := h.home(c)
+	for ; ; i = (i + 1) & h.mask() {
+		s := &h.slots[i]
+		if s.n == nil {
+			return
+		}
+		if s.c == c {
+			break
+		}
+	}
+
+	h.count--
+	for j := (i + 1) & h.mask(); h.slots[j].n != nil; j = (j + 1) & h.mask() {
+		// slot j can be moved back to hole i only if its home is not in (i, j]
+		home := h.home(h.slots[j].c)
+		if (j-home)&h.mask() >= (j-i)&h.mask() {
+			h.slots[i] = h.slots[j]
+			i = j
+		}
+	}
+	h.slots[i] = hashSlot[V]{}
+}
+
+func (h *hashClusters[V]) resize(capacity int) {
+	old := h.slots
+	h.slots = make([]hashSlot[V], capacity)
+	h.shift = 64 - uint8(bits.TrailingZeros(uint(capacity)))
+	h.count = 0
+	for _, s := range old {
+		if s.n != nil {
+			h.set(s.c, s.n)
+		}
+	}
+}
+
+func (h *hashClusters[V]) each(fn func(c uint64, n *node[V])) {
+	for _, s := range h.slots {
+		if s.n != nil {
+			fn(s.c, s.n)
+		}
+	}
+}
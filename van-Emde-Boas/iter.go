@@ -0,0 +1,148 @@
+package vEB
+
+import (
+	"iter"
+	"math/bits"
+)
+
+// Range call fn for each element in [lo, hi] in ascending order until fn returns false
+func (t *Tree) Range(lo, hi uint64, fn func(x uint64) bool) {
+	if lo > hi {
+		return
+	}
+	ascend(t.root, t.bits, 0, lo, min(hi, universeMax(t.bits)), func(x uint64, _ struct{}) bool {
+		return fn(x)
+	})
+}
+
+// All iterator over all elements in ascending order
+func (t *Tree) All() iter.Seq[uint64] {
+	return t.Ascend(0)
+}
+
+// Ascend iterator over elements >= from in ascending order
+func (t *Tree) Ascend(from uint64) iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		t.Range(from, universeMax(t.bits), yield)
+	}
+}
+
+// Descend iterator over elements <= from in descending order
+func (t *Tree) Descend(from uint64) iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		descend(t.root, t.bits, 0, 0, min(from, universeMax(t.bits)), func(x uint64, _ struct{}) bool {
+			return yield(x)
+		})
+	}
+}
+
+// universeMax the largest element of universe with bits width
+func universeMax(bits uint8) uint64 {
+	return ^uint64(0) >> (maxBits - bits)
+}
+
+// ascend visit elements of n in [lo, hi] (relative to n) in ascending order, base is added to each element.
+// Clusters are found by walking summary, so that empty clusters are skipped.
+// Return false if stopped by fn.
+func ascend[V any](n *node[V], bits uint8, base, lo, hi uint64, fn func(x uint64, v V) bool) bool {
+	if n == nil || lo > hi || n.max < lo || n.min > hi {
+		return true
+	}
+	if isLeaf(bits) {
+		return leafAscend(n, base, lo, hi, fn)
+	}
+
+	if n.min >= lo && !fn(base+n.min, n.minVal) {
+		return false
+	}
+
+	if n.clusters != nil {
+		clo, ilo := split(lo, bits)
+		chi, ihi := split(hi, bits)
+		ok := ascend(n.summary, highBits(bits), 0, clo, chi, func(c uint64, _ int) bool {
+			l, h := uint64(0), universeMax(lowBits(bits))
+			if c == clo {
+				l = ilo
+			}
+			if c == chi {
+				h = ihi
+			}
+			return ascend(n.clusters.get(c), lowBits(bits), base+concat(c, 0, bits), l, h, fn)
+		})
+		if !ok {
+			return false
+		}
+	}
+
+	if n.max != n.min && n.max <= hi {
+		return fn(base+n.max, n.maxVal)
+	}
+	return true
+}
+
+// descend visit elements of n in [lo, hi] (relative to n) in descending order, see ascend.
+func descend[V any](n *node[V], bits uint8, base, lo, hi uint64, fn func(x uint64, v V) bool) bool {
+	if n == nil || lo > hi || n.max < lo || n.min > hi {
+		return true
+	}
+	if isLeaf(bits) {
+		return leafDescend(n, base, lo, hi, fn)
+	}
+
+	if n.max <= hi && !fn(base+n.max, n.maxVal) {
+		return false
+	}
+
+	if n.clusters != nil {
+		clo, ilo := split(lo, bits)
+		chi, ihi := split(hi, bits)
+		ok := descend(n.summary, highBits(bits), 0, clo, chi, func(c uint64, _ int) bool {
+			l, h := uint64(0), universeMax(lowBits(bits))
+			if c == clo {
+				l = ilo
+			}
+			if c == chi {
+				h = ihi
+			}
+			return descend(n.clusters.get(c), lowBits(bits), base+concat(c, 0, bits), l, h, fn)
+		})
+		if !ok {
+			return false
+		}
+	}
+
+	if n.max != n.min && n.min >= lo {
+		return fn(base+n.min, n.minVal)
+	}
+	return true
+}
+
+// leafRange bits of leaf in [lo, hi]
+func leafRange[V any](n *node[V], lo, hi uint64) uint64 {
+	m := n.mask &^ (1<<lo - 1)
+	if hi < 63 {
+		m &= 1<<(hi+1) - 1
+	}
+	return m
+}
+
+func leafAscend[V any](n *node[V], base, lo, hi uint64, fn func(x uint64, v V) bool) bool {
+	for m := leafRange(n, lo, hi); m != 0; m &= m - 1 {
+		x := uint64(bits.TrailingZeros64(m))
+		if !fn(base+x, n.vals[x]) {
+			return false
+		}
+	}
+	return true
+}
+
+func leafDescend[V any](n *node[V], base, lo, hi uint64, fn func(x uint64, v V) bool) bool {
+	for m := leafRange(n, lo, hi); m != 0; {
+		x := uint64(63 - bits.LeadingZeros64(m))
+		if !fn(base+x, n.vals[x]) {
+			return false
+		}
+		m &^= 1 << x
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package vEB
+
+import (
+	"math/bits"
+)
+
+const (
+	// leafBits max width of universe stored as a bit-packed leaf
+	leafBits = 6
+)
+
+// A leaf is a node whose universe has at most 64 elements, all of which (including min and max)
+// are stored in `mask`. min/max are kept up to date because parent reads them directly.
+
+func isLeaf(bits uint8) bool {
+	return bits <= leafBits
+}
+
+func newLeaf[V any](x uint64, v V, w weigher[V]) *node[V] {
+	n := &node[V]{min: x, max: x, count: w(v), mask: 1 << x, vals: new([64]V)}
+	n.vals[x] = v
+	return n
+}
+
+func leafFind[V any](n *node[V], x uint64) (V, bool) {
+	if x >= 64 || n.mask&(1<<x) == 0 {
+		var zero V
+		return zero, false
+	}
+	return n.vals[x], true
+}
+
+func leafSuccessor[V any](n *node[V], x uint64) (uint64, V, bool) {
+	var zero V
+	if x >= 63 {
+		return 0, zero, false
+	}
+	m := n.mask &^ (1<<(x+1) - 1)
+	if m == 0 {
+		return 0, zero, false
+	}
+	x = uint64(bits.TrailingZeros64(m))
+	return x, n.vals[x], true
+}
+
+func leafPredecessor[V any](n *node[V], x uint64) (uint64, V, bool) {
+	var zero V
+	if x > 63 {
+		x = 64
+	}
+	m := n.mask & (1<<x - 1)
+	if m == 0 {
+		return 0, zero, false
+	}
+	x = uint64(63 - bits.LeadingZeros64(m))
+	return x, n.vals[x], true
+}
+
+func leafInsert[V any](n *node[V], x uint64, v V, w weigher[V]) (*node[V], int) {
+	if n == nil {
+		return newLeaf(x, v, w), w(v)
+	}
+	if n.mask&(1<<x) != 0 {
+		d := w(v) - w(n.vals[x])
+		n.vals[x] = v
+		n.count += d
+		return n, d
+	}
+	n.vals[x] = v
+	n.mask |= 1 << x
+	n.count += w(v)
+	n.min = uint64(bits.TrailingZeros64(n.mask))
+	n.max = uint64(63 - bits.LeadingZeros64(n.mask))
+	return n, w(v)
+}
+
+func leafDelete[V any](n *node[V], x uint64, w weigher[V]) (*node[V], V, bool) {
+	var zero V
+	if x >= 64 || n.mask&(1<<x) == 0 {
+		return n, zero, false
+	}
+	v := n.vals[x]
+	n.vals[x] = zero // release reference held by value
+	n.mask &^= 1 << x
+	n.count -= w(v)
+	if n.mask == 0 {
+		return nil, v, true
+	}
+	n.min = uint64(bits.TrailingZeros64(n.mask))
+	n.max = uint64(63 - bits.LeadingZeros64(n.mask))
+	return n, v, true
+}
@@ -0,0 +1,82 @@
+package vEB
+
+import (
+	"iter"
+)
+
+// Map ordered map of uint64 keys backed by vEB tree, each key is associated with a value of V.
+// Like Insert/Delete of Tree, Put and Delete take O(log U) steps to keep counts of clusters.
+type Map[V any] struct {
+	root  *node[V]
+	count int
+	bits  uint8 // universe of keys is [0, 2^bits)
+	store ClusterStore
+}
+
+// NewMap create map with 64 bits universe of keys
+func NewMap[V any](opts ...Option) *Map[V] {
+	return NewMapWithBits[V](maxBits, opts...)
+}
+
+// NewMapWithBits create map with universe of keys [0, 2^w), w must be in [1, 64]
+func NewMapWithBits[V any](w uint8, opts ...Option) *Map[V] {
+	o := newOptions(w, opts)
+	return &Map[V]{bits: w, store: o.store}
+}
+
+// Bits return width of universe of keys
+func (m *Map[V]) Bits() uint8 {
+	return m.bits
+}
+
+// Len return number of keys
+func (m *Map[V]) Len() int {
+	return m.count
+}
+
+// Get return value of k, false if k does not exist
+func (m *Map[V]) Get(k uint64) (V, bool) {
+	return find(m.root, k, m.bits)
+}
+
+// Put associate v with k, replacing old value if k exists.
+// Return ErrOutOfRange if k does not fit in universe.
+func (m *Map[V]) Put(k uint64, v V) error {
+	if !inUniverse(k, m.bits) {
+		return ErrOutOfRange
+	}
+	var added int
+	m.root, added = insert(m.root, k, v, m.bits, m.store, unitWeight)
+	m.count += added
+	return nil
+}
+
+// Delete remove k from map, return its value and whether it exists
+func (m *Map[V]) Delete(k uint64) (V, bool) {
+	var (
+		v       V
+		removed bool
+	)
+	m.root, v, removed = delete2(m.root, k, m.bits, unitWeight)
+	if removed {
+		m.count--
+	}
+	return v, removed
+}
+
+// SuccessorEntry return the smallest key > k and its value, false if not exists
+func (m *Map[V]) SuccessorEntry(k uint64) (uint64, V, bool) {
+	return successor(m.root, k, m.bits)
+}
+
+// PredecessorEntry return the largest key < k and its value, false if not exists
+func (m *Map[V]) PredecessorEntry(k uint64) (uint64, V, bool) {
+	return predecessor(m.root, k, m.bits)
+}
+
+// All iterator over all keys/values in ascending order of key
+func (m *Map[V]) All() iter.Seq2[uint64, V] {
+	return func(yield func(uint64, V) bool) {
+		ascend(m.root, m.bits, 0, 0, universeMax(m.bits), yield)
+	}
+}
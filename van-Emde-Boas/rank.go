@@ -0,0 +1,94 @@
+package vEB
+
+import (
+	"math/bits"
+)
+
+// Rank return number of elements less than x.
+// Summary holds counts of clusters, so rank goes down through both summary and cluster of each level
+// instead of scanning clusters, which takes O(log U) steps.
+func (t *Tree) Rank(x uint64) int {
+	return rank(t.root, x, t.bits, unitWeight)
+}
+
+// Select return the k-th (0-based) smallest element, false if k is out of [0, Len()).
+// Like Rank, it takes O(log U) steps.
+func (t *Tree) Select(k int) (uint64, bool) {
+	if k < 0 || k >= t.count {
+		return 0, false
+	}
+	x, _ := selectAt(t.root, k, t.bits, unitWeight)
+	return x, true
+}
+
+// rank total weight of elements of n less than x
+func rank[V any](n *node[V], x uint64, bits uint8, w weigher[V]) int {
+	if n == nil || x <= n.min {
+		return 0
+	}
+	if x > n.max {
+		return n.count
+	}
+	if isLeaf(bits) {
+		return leafRank(n, x, w)
+	}
+
+	// min < x <= max, and max is not counted.
+	// Weight of clusters before the one of x is the rank of its index in summary.
+	c, i := split(x, bits)
+	return w(n.minVal) + rank(n.summary, c, highBits(bits), clusterWeight) + rank(n.cluster(c), i, lowBits(bits), w)
+}
+
+// selectAt return the element of n covering weight k (0-based) when weights of elements are accumulated in
+// ascending order, and the offset of k in weight of the element. k must be in [0, n.count).
+func selectAt[V any](n *node[V], k int, bits uint8, w weigher[V]) (uint64, int) {
+	if isLeaf(bits) {
+		return leafSelect(n, k, w)
+	}
+	if k < w(n.minVal) {
+		return n.min, k
+	}
+	k -= w(n.minVal)
+	if n.summary == nil || k >= n.summary.count {
+		if n.summary != nil {
+			k -= n.summary.count
+		}
+		return n.max, k
+	}
+
+	// find cluster covering k by summary, then the element in cluster
+	c, k := selectAt(n.summary, k, highBits(bits), clusterWeight)
+	i, k := selectAt(n.clusters.get(c), k, lowBits(bits), w)
+	return concat(c, i, bits), k
+}
+
+func leafRank[V any](n *node[V], x uint64, w weigher[V]) int {
+	m := n.mask & (1<<x - 1)
+	if n.count == bits.OnesCount64(n.mask) {
+		// all weights are 1
+		return bits.OnesCount64(m)
+	}
+	r := 0
+	for ; m != 0; m &= m - 1 {
+		r += w(n.vals[bits.TrailingZeros64(m)])
+	}
+	return r
+}
+
+func leafSelect[V any](n *node[V], k int, w weigher[V]) (uint64, int) {
+	m := n.mask
+	if n.count == bits.OnesCount64(n.mask) {
+		// all weights are 1
+		for ; k > 0; k-- {
+			m &= m - 1
+		}
+		return uint64(bits.TrailingZeros64(m)), 0
+	}
+	for ; ; m &= m - 1 {
+		x := uint64(bits.TrailingZeros64(m))
+		if k < w(n.vals[x]) {
+			return x, k
+		}
+		k -= w(n.vals[x])
+	}
+}
@@ -0,0 +1,264 @@
+package vEB
+
+import (
+	"errors"
+)
+
+var ErrUniverseMismatch = errors.New("vEB: trees have different universes")
+
+// setOp set operation between two trees
+type setOp int
+
+const (
+	opUnion setOp = iota
+	opIntersect
+	opDifference
+	opSymmetricDifference
+)
+
+// keep whether element is in result given its membership in both operands
+func (op setOp) keep(inA, inB bool) bool {
+	switch op {
+	case opUnion:
+		return inA || inB
+	case opIntersect:
+		return inA && inB
+	case opDifference:
+		return inA && !inB
+	default:
+		return inA != inB
+	}
+}
+
+func (op setOp) mask(a, b uint64) uint64 {
+	switch op {
+	case opUnion:
+		return a | b
+	case opIntersect:
+		return a & b
+	case opDifference:
+		return a &^ b
+	default:
+		return a ^ b
+	}
+}
+
+// Union return a new tree holding elements in a or b
+func Union(a, b *Tree) (*Tree, error) {
+	return combineTrees(a, b, opUnion)
+}
+
+// Intersect return a new tree holding elements in both a and b
+func Intersect(a, b *Tree) (*Tree, error) {
+	return combineTrees(a, b, opIntersect)
+}
+
+// Difference return a new tree holding elements in a but not in b
+func Difference(a, b *Tree) (*Tree, error) {
+	return combineTrees(a, b, opDifference)
+}
+
+// SymmetricDifference return a new tree holding elements in exactly one of a and b
+func SymmetricDifference(a, b *Tree) (*Tree, error) {
+	return combineTrees(a, b, opSymmetricDifference)
+}
+
+// Equal check if a and b have the same universe and elements.
+// The layout of a tree is determined by its elements, so trees are compared node by node.
+func Equal(a, b *Tree) bool {
+	return a.bits == b.bits && a.count == b.count && equalNode(a.root, b.root, a.bits)
+}
+
+func combineTrees(a, b *Tree, op setOp) (*Tree, error) {
+	if a.bits != b.bits {
+		return nil, ErrUniverseMismatch
+	}
+	t := &Tree{bits: a.bits, store: a.store}
+	t.root = combine(a.root, b.root, t.bits, op, t.store)
+	if t.root != nil {
+		t.count = t.root.count
+	}
+	return t, nil
+}
+
+// combine return a new node holding result of op on elements of a and b, nil if it's empty.
+// Clusters are combined pairwise, then min/max of a and b, which are not stored in clusters,
+// are added to or removed from the result.
+func combine(a, b *node[struct{}], bits uint8, op setOp, store ClusterStore) *node[struct{}] {
+	if a == nil && (b == nil || op == opIntersect || op == opDifference) {
+		return nil
+	}
+	if b == nil && op == opIntersect {
+		return nil
+	}
+	if isLeaf(bits) {
+		return combineLeaf(a, b, op)
+	}
+
+	var (
+		clusters clusterTable[struct{}]
+		indexes  []uint64
+		count    int
+	)
+	for _, c := range op.clusterIndexes(a, b, bits) {
+		cluster := combine(a.cluster(c), b.cluster(c), lowBits(bits), op, store)
+		if cluster == nil {
+			continue
+		}
+		if clusters == nil {
+			clusters = newClusterTable[struct{}](highBits(bits), store)
+		}
+		clusters.set(c, cluster)
+		indexes = append(indexes, c)
+		count += cluster.count
+	}
+	n := promote(clusters, indexes, count, bits, store)
+
+	for _, x := range candidates(a, b) {
+		_, inA := find(a, x, bits)
+		_, inB := find(b, x, bits)
+		if op.keep(inA, inB) {
+			n, _ = insert(n, x, struct{}{}, bits, store, unitWeight)
+		} else {
+			n, _, _ = delete2(n, x, bits, unitWeight)
+		}
+	}
+	return n
+}
+
+func combineLeaf(a, b *node[struct{}], op setOp) *node[struct{}] {
+	var am, bm uint64
+	if a != nil {
+		am = a.mask
+	}
+	if b != nil {
+		bm = b.mask
+	}
+	m := op.mask(am, bm)
+	if m == 0 {
+		return nil
+	}
+	return buildLeafMask(m)
+}
+
+// clusterIndexes sorted indexes of clusters which may be non-empty in result
+func (op setOp) clusterIndexes(a, b *node[struct{}], bits uint8) []uint64 {
+	ai, bi := clusterIndexes(a, bits), clusterIndexes(b, bits)
+	switch op {
+	case opIntersect:
+		var out []uint64
+		for _, c := range ai {
+			if b.cluster(c) != nil {
+				out = append(out, c)
+			}
+		}
+		return out
+	case opDifference:
+		return ai
+	default:
+		return mergeSorted(ai, bi)
+	}
+}
+
+// clusterIndexes sorted indexes of non-empty clusters of n
+func clusterIndexes[V any](n *node[V], bits uint8) []uint64 {
+	if n == nil || n.summary == nil {
+		return nil
+	}
+	var out []uint64
+	ascend(n.summary, highBits(bits), 0, 0, universeMax(highBits(bits)), func(c uint64, _ int) bool {
+		out = append(out, c)
+		return true
+	})
+	return out
+}
+
+// mergeSorted union of two sorted slices without duplicates
+func mergeSorted(a, b []uint64) []uint64 {
+	out := make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// candidates min/max of a and b
+func candidates(a, b *node[struct{}]) []uint64 {
+	var out []uint64
+	for _, n := range []*node[struct{}]{a, b} {
+		if n != nil {
+			out = append(out, n.min, n.max)
+		}
+	}
+	return out
+}
+
+// promote make node from clusters with sorted indexes holding count elements in total, whose smallest and
+// largest elements are moved out of clusters to be min/max of node. Return nil if there is no cluster.
+func promote(clusters clusterTable[struct{}], indexes []uint64, count int, bits uint8, store ClusterStore) *node[struct{}] {
+	if len(indexes) == 0 {
+		return nil
+	}
+	weights := make([]int, len(indexes))
+	for j, c := range indexes {
+		weights[j] = clusters.get(c).count
+	}
+	n := &node[struct{}]{
+		count:    count,
+		summary:  build(indexes, weights, highBits(bits), store, false, clusterWeight),
+		clusters: clusters,
+	}
+
+	c := n.summary.min
+	i := clusters.get(c).min
+	n.min = concat(c, i, bits)
+	n.max = n.min
+	n.removeFromCluster(c, i, bits)
+
+	if n.summary != nil {
+		c = n.summary.max
+		i = clusters.get(c).max
+		n.max = concat(c, i, bits)
+		n.removeFromCluster(c, i, bits)
+	}
+	return n
+}
+
+// removeFromCluster delete i from cluster c of tree node, and drop the cluster if it becomes empty
+func (n *node[V]) removeFromCluster(c, i uint64, bits uint8) {
+	after, _, _ := delete2(n.clusters.get(c), i, lowBits(bits), unitWeight)
+	n.updateSummary(c, after, bits)
+}
+
+func equalNode[V any](a, b *node[V], bits uint8) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.min != b.min || a.max != b.max {
+		return false
+	}
+	if isLeaf(bits) {
+		return a.mask == b.mask
+	}
+	if !equalNode(a.summary, b.summary, highBits(bits)) {
+		return false
+	}
+	for _, c := range clusterIndexes(a, bits) {
+		if !equalNode(a.cluster(c), b.cluster(c), lowBits(bits)) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,191 +1,467 @@
 package vEB
 
 import (
+	"errors"
 	"fmt"
 )
 
 // reference: https://www.mi.fu-berlin.de/inf/groups/ag-ti/theses/download/Ehrhardt15.pdf
 
+const (
+	maxBits = 64
+)
+
+var ErrOutOfRange = errors.New("vEB: element out of universe")
+
+// Tree van Emde Boas tree of uint64 elements. Find, Successor and Predecessor take O(log log U) steps, while
+// Insert and Delete take O(log U) as they update counts of clusters in summary of each level for Rank/Select.
 type Tree struct {
-	root  *node
+	root  *node[struct{}]
 	count int
+	bits  uint8 // universe is [0, 2^bits)
+	store ClusterStore
 }
 
-func NewTree() *Tree {
-	return &Tree{}
+// Option configure Tree or Map on creation
+type Option func(*options)
+
+type options struct {
+	store ClusterStore
+}
+
+// WithClusterStore set how clusters of large levels are stored, default is ClusterMap
+func WithClusterStore(s ClusterStore) Option {
+	return func(o *options) {
+		o.store = s
+	}
+}
+
+// NewTree create tree with 64 bits universe
+func NewTree(opts ...Option) *Tree {
+	return NewTreeWithBits(maxBits, opts...)
+}
+
+// NewTreeWithBits create tree with universe [0, 2^w), w must be in [1, 64]
+func NewTreeWithBits(w uint8, opts ...Option) *Tree {
+	o := newOptions(w, opts)
+	return &Tree{bits: w, store: o.store}
+}
+
+func newOptions(w uint8, opts []Option) options {
+	if w == 0 || w > maxBits {
+		panic(fmt.Sprintf("vEB: invalid universe width %d", w))
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Bits return width of universe
+func (t *Tree) Bits() uint8 {
+	return t.bits
 }
 
 func (t *Tree) Find(x uint64) bool {
-	return find(t.root, x, 64)
+	_, found := find(t.root, x, t.bits)
+	return found
 }
 
-func (t *Tree) Insert(x uint64) {
-	t.root = insert(t.root, x, 64)
+// Insert add x to tree, return ErrOutOfRange if x does not fit in universe.
+// It takes O(log U) steps to update counts along the way down, see Tree.
+func (t *Tree) Insert(x uint64) error {
+	if !inUniverse(x, t.bits) {
+		return ErrOutOfRange
+	}
+	var added int
+	t.root, added = insert(t.root, x, struct{}{}, t.bits, t.store, unitWeight)
+	t.count += added
+	return nil
 }
 
 func (t *Tree) Successor(x uint64) (uint64, bool) {
-	return successor(t.root, x, 64)
+	x, _, found := successor(t.root, x, t.bits)
+	return x, found
+}
+
+func (t *Tree) Predecessor(x uint64) (uint64, bool) {
+	x, _, found := predecessor(t.root, x, t.bits)
+	return x, found
 }
 
+// Delete remove x from tree, it takes O(log U) steps like Insert
 func (t *Tree) Delete(x uint64) {
-	t.root = delete2(t.root, x, 64)
+	var removed bool
+	t.root, _, removed = delete2(t.root, x, t.bits, unitWeight)
+	if removed {
+		t.count--
+	}
+}
+
+// inUniverse check if x is in universe of bits width
+func inUniverse(x uint64, bits uint8) bool {
+	return bits == maxBits || x < 1<<bits
 }
 
-type node struct {
+// Min return the smallest element, false if tree is empty
+func (t *Tree) Min() (uint64, bool) {
+	if t.root == nil {
+		return 0, false
+	}
+	return t.root.min, true
+}
+
+// Max return the largest element, false if tree is empty
+func (t *Tree) Max() (uint64, bool) {
+	if t.root == nil {
+		return 0, false
+	}
+	return t.root.max, true
+}
+
+// Len return number of elements
+func (t *Tree) Len() int {
+	return t.count
+}
+
+// node of tree, V is type of values associated with elements.
+// Summary holds cluster indexes whose values are weights of clusters, i.e. their counts, so that rank and
+// select go down through summary instead of scanning it.
+type node[V any] struct {
 	min      uint64 // NOT stored recursively
 	max      uint64 // NOT stored recursively
-	summary  *node
-	clusters map[uint64]*node // TODO: use perfect hash
+	count    int    // total weight of elements including min/max, which is number of elements except in summary
+	minVal   V
+	maxVal   V
+	summary  *node[int]
+	clusters clusterTable[V] // nil until the node holds more than 2 elements
+	mask     uint64          // all elements of leaf
+	vals     *[64]V          // values of leaf indexed by element
+}
+
+// weigher weight of element by its value
+type weigher[V any] func(v V) int
+
+// unitWeight weight of element of tree/map
+func unitWeight[V any](V) int {
+	return 1
+}
+
+// clusterWeight weight of element of summary, which is count of the cluster
+func clusterWeight(w int) int {
+	return w
+}
+
+func newNode[V any](x uint64, v V, w weigher[V]) *node[V] {
+	return &node[V]{min: x, max: x, count: w(v), minVal: v, maxVal: v}
+}
+
+// cluster get cluster c, nil if not exists or n is nil
+func (n *node[V]) cluster(c uint64) *node[V] {
+	if n == nil || n.clusters == nil {
+		return nil
+	}
+	return n.clusters.get(c)
 }
 
-func newNode(x uint64) *node {
-	return &node{min: x, max: x}
+// minValue value of min, which is stored in vals for leaf
+func (n *node[V]) minValue() V {
+	if n.mask != 0 {
+		return n.vals[n.min]
+	}
+	return n.minVal
 }
 
-func find(n *node, x uint64, bits uint8) bool {
+// maxValue value of max, which is stored in vals for leaf
+func (n *node[V]) maxValue() V {
+	if n.mask != 0 {
+		return n.vals[n.max]
+	}
+	return n.maxVal
+}
+
+func find[V any](n *node[V], x uint64, bits uint8) (V, bool) {
+	var zero V
 	if n == nil {
-		return false
+		return zero, false
 	}
-	if x == n.min || x == n.max {
-		return true
+	if isLeaf(bits) {
+		return leafFind(n, x)
+	}
+	if x == n.min {
+		return n.minVal, true
+	}
+	if x == n.max {
+		return n.maxVal, true
 	}
 	if x < n.min || x > n.max {
-		return false
+		return zero, false
 	}
 	c, i := split(x, bits)
-	return find(n.clusters[c], i, bits/2)
+	return find(n.cluster(c), i, lowBits(bits))
 }
 
-func successor(n *node, x uint64, bits uint8) (uint64, bool) {
+func successor[V any](n *node[V], x uint64, bits uint8) (uint64, V, bool) {
+	var zero V
 	if n == nil {
-		return 0, false
+		return 0, zero, false
+	}
+	if isLeaf(bits) {
+		return leafSuccessor(n, x)
 	}
 	if x >= n.max {
-		return 0, false
+		return 0, zero, false
 	}
 
 	if x < n.min {
-		return n.min, true
+		return n.min, n.minVal, true
 	}
 
 	// successor must be found from now on
 	c, i := split(x, bits)
-	cluster := n.clusters[c]
+	cluster := n.cluster(c)
 
 	if cluster != nil && i < cluster.max {
-		i, _ = successor(cluster, i, bits/2)
-		return concat(c, i, bits), true
+		i, v, _ := successor(cluster, i, lowBits(bits))
+		return concat(c, i, bits), v, true
+	}
+
+	c, _, found := successor(n.summary, c, highBits(bits))
+	if !found {
+		return n.max, n.maxVal, true
+	}
+	cluster = n.clusters.get(c)
+	return concat(c, cluster.min, bits), cluster.minValue(), true
+}
+
+func predecessor[V any](n *node[V], x uint64, bits uint8) (uint64, V, bool) {
+	var zero V
+	if n == nil {
+		return 0, zero, false
+	}
+	if isLeaf(bits) {
+		return leafPredecessor(n, x)
+	}
+	if x <= n.min {
+		return 0, zero, false
+	}
+
+	if x > n.max {
+		return n.max, n.maxVal, true
+	}
+
+	// predecessor must be found from now on
+	c, i := split(x, bits)
+	cluster := n.cluster(c)
+
+	if cluster != nil && i > cluster.min {
+		i, v, _ := predecessor(cluster, i, lowBits(bits))
+		return concat(c, i, bits), v, true
 	}
 
-	c, found := successor(n.summary, c, bits/2)
+	c, _, found := predecessor(n.summary, c, highBits(bits))
 	if !found {
-		return n.max, true
+		return n.min, n.minVal, true
 	}
-	return concat(c, n.clusters[c].min, bits), true
+	cluster = n.clusters.get(c)
+	return concat(c, cluster.max, bits), cluster.maxValue(), true
 }
 
-func insert(n *node, x uint64, bits uint8) *node {
+// insert return node after insertion and change of its weight, which is weight of v if x is newly added.
+// Value of x is replaced with v if x already exists.
+// Weight of cluster changed by insertion is updated in summary.
+func insert[V any](n *node[V], x uint64, v V, bits uint8, store ClusterStore, w weigher[V]) (*node[V], int) {
+	if isLeaf(bits) {
+		return leafInsert(n, x, v, w)
+	}
 	if n == nil {
-		return newNode(x)
+		return newNode(x, v, w), w(v)
 	}
+	if x == n.min || x == n.max {
+		old := n.minVal
+		if x == n.max {
+			old = n.maxVal
+		}
+		if x == n.min {
+			n.minVal = v
+		}
+		if x == n.max {
+			n.maxVal = v
+		}
+		d := w(v) - w(old)
+		n.count += d
+		return n, d
+	}
+
+	// x is new to node if it's out of [min, max]
+	added := 0
 	if x < n.min {
 		// swap because min is not stored recursively
+		added = w(v)
 		x, n.min = n.min, x
+		v, n.minVal = n.minVal, v
 	}
 	if x > n.max {
-		// swap because min is not stored recursively
+		// swap because max is not stored recursively
+		added = w(v)
 		x, n.max = n.max, x
+		v, n.maxVal = n.maxVal, v
 	}
 	if n.min == x || n.max == x {
-		return n
+		n.count += added
+		return n, added
 	}
 
 	// lazy allocation
 	if n.clusters == nil {
-		n.clusters = make(map[uint64]*node)
+		n.clusters = newClusterTable[V](highBits(bits), store)
 	}
 
 	c, i := split(x, bits)
-	cluster := n.clusters[c]
-	if cluster == nil {
-		n.summary = insert(n.summary, c, bits/2)
+	cluster, d := insert(n.clusters.get(c), i, v, lowBits(bits), store, w)
+	n.clusters.set(c, cluster)
+	if d != 0 {
+		n.summary, _ = insert(n.summary, c, cluster.count, highBits(bits), store, clusterWeight)
+	}
+	if added == 0 {
+		// x is passed down to cluster as is
+		added = d
 	}
-	n.clusters[c] = insert(cluster, i, bits/2)
-	return n
+	n.count += added
+	return n, added
 }
 
-func delete2(n *node, x uint64, bits uint8) *node {
+// delete2 return node after deletion (nil if it becomes empty), value of x and whether x is removed.
+// Weight of cluster changed by deletion is updated in summary.
+func delete2[V any](n *node[V], x uint64, bits uint8, w weigher[V]) (*node[V], V, bool) {
+	var zero V
 	if n == nil {
-		return nil
+		return nil, zero, false
+	}
+	if isLeaf(bits) {
+		return leafDelete(n, x, w)
 	}
 	if x < n.min || x > n.max {
-		return n
+		return n, zero, false
 	}
 
 	// element count = 1
 	if n.min == n.max {
 		if n.min == x {
-			return nil
+			return nil, n.minVal, true
 		}
-		return n
+		return n, zero, false
 	}
 
 	// element count = 2
 	if n.summary == nil {
 		if n.min == x {
-			n.min = n.max
+			v := n.minVal
+			n.min, n.minVal = n.max, n.maxVal
+			n.count -= w(v)
+			return n, v, true
 		}
 		if n.max == x {
-			n.max = n.min
+			v := n.maxVal
+			n.max, n.maxVal = n.min, n.minVal
+			n.count -= w(v)
+			return n, v, true
 		}
-		return n
+		return n, zero, false
 	}
 
 	// element count > 2
 	c, i := split(x, bits)
+	removed := false
+	val := zero
 
 	if n.min == x {
+		removed, val = true, n.minVal
 		c = n.summary.min
-		i = n.clusters[c].min  // cluster c must exist
+		cluster := n.clusters.get(c) // cluster c must exist
+		i = cluster.min
 		x = concat(c, i, bits) // new x to delete from clusters
-		n.min = x
+		n.min, n.minVal = x, cluster.minValue()
 	}
 
 	if n.max == x {
+		removed, val = true, n.maxVal
 		c = n.summary.max
-		i = n.clusters[c].max  // cluster c must exist
+		cluster := n.clusters.get(c) // cluster c must exist
+		i = cluster.max
 		x = concat(c, i, bits) // new x to delete from clusters
-		n.max = x
+		n.max, n.maxVal = x, cluster.maxValue()
 	}
 
-	cluster := n.clusters[c]
+	cluster := n.clusters.get(c)
 	if cluster == nil {
-		return n
+		return n, val, removed
+	}
+	after, v, found := delete2(cluster, i, lowBits(bits), w)
+	if !removed {
+		val = v
 	}
-	if after := delete2(cluster, i, bits/2); after == nil {
-		delete(n.clusters, c)
-		n.summary = delete2(n.summary, c, bits/2)
+	if !removed && !found {
+		return n, val, false
+	}
+
+	n.updateSummary(c, after, bits)
+	n.count -= w(val)
+	return n, val, true
+}
+
+// updateSummary update weight of cluster c in summary after it's changed to after,
+// and drop the cluster if it becomes empty
+func (n *node[V]) updateSummary(c uint64, after *node[V], bits uint8) {
+	if after != nil {
+		//n.clusters[c] = after // unnecessary
+		// c is already in summary, so no cluster table is created and store doesn't matter
+		n.summary, _ = insert(n.summary, c, after.count, highBits(bits), ClusterMap, clusterWeight)
+		return
+	}
+	n.clusters.remove(c)
+	n.summary, _, _ = delete2(n.summary, c, highBits(bits), clusterWeight)
+	if n.summary == nil {
+		n.clusters = nil
 	}
-	//n.clusters[c] = after // unnecessary
-	return n
+}
+
+// highBits width of cluster index (universe of summary), which is the larger half for odd bits
+func highBits(bits uint8) uint8 {
+	return bits - bits/2
+}
+
+// lowBits width of index in cluster (universe of cluster).
+// Universe not much larger than a leaf is split into leaves directly instead of halves.
+func lowBits(bits uint8) uint8 {
+	if bits > leafBits && bits <= 2*leafBits {
+		return leafBits
+	}
+	return bits / 2
 }
 
 func split(x uint64, bits uint8) (uint64, uint64) {
-	return x >> (bits / 2), x & (1<<(bits/2) - 1)
+	return x >> lowBits(bits), x & (1<<lowBits(bits) - 1)
 }
 
 func concat(c, i uint64, bits uint8) uint64 {
-	return c<<(bits/2) | i
+	return c<<lowBits(bits) | i
 }
 
-func debugNode(n *node) string {
+func debugNode[V any](n *node[V]) string {
 	if n == nil {
 		return "<nil>"
 	}
+	if n.mask != 0 {
+		return fmt.Sprintf("(min=%d max=%d mask=%#x)", n.min, n.max, n.mask)
+	}
 
 	var clusters []uint64
-	for c := range n.clusters {
-		clusters = append(clusters, c)
+	if n.clusters != nil {
+		n.clusters.each(func(c uint64, _ *node[V]) {
+			clusters = append(clusters, c)
+		})
 	}
 	return fmt.Sprintf("(min=%d max=%d c=%v)", n.min, n.max, clusters)
 }
@@ -198,22 +474,24 @@ func debugTree(t *Tree) string {
 		return out
 	}
 
-	nodeQueue := []*node{t.root}
+	nodeQueue := []*node[struct{}]{t.root}
 	depthQueue := []int{0}
 	prevDepth := -1
 	for len(nodeQueue) > 0 {
-		node, depth := nodeQueue[0], depthQueue[0]
+		n, depth := nodeQueue[0], depthQueue[0]
 		nodeQueue, depthQueue = nodeQueue[1:], depthQueue[1:]
 
 		if depth != prevDepth {
 			out += fmt.Sprintf("\n%d:", depth)
 		}
 		prevDepth = depth
-		out += " " + debugNode(node) + " "
+		out += " " + debugNode(n) + " "
 
-		for c := range node.clusters {
-			nodeQueue = append(nodeQueue, node.clusters[c])
-			depthQueue = append(depthQueue, depth+1)
+		if n.clusters != nil {
+			n.clusters.each(func(_ uint64, cluster *node[struct{}]) {
+				nodeQueue = append(nodeQueue, cluster)
+				depthQueue = append(depthQueue, depth+1)
+			})
 		}
 	}
 	return out
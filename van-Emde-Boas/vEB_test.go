@@ -1,6 +1,10 @@
 package vEB
 
 import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -93,3 +97,676 @@ func TestTree_Delete(t *testing.T) {
 	}
 	assert.True(t, tree.Find(9999))
 }
+
+func TestTree_Predecessor(t *testing.T) {
+	tree := NewTree()
+
+	for x := uint64(0); x < 10000; x++ {
+		tree.Insert(x)
+	}
+
+	for x := uint64(1); x < 10000; x++ {
+		p, found := tree.Predecessor(x)
+		assert.True(t, found)
+		assert.Equal(t, x-1, p)
+	}
+
+	for x := uint64(10000); x < 20000; x++ {
+		p, found := tree.Predecessor(x)
+		assert.True(t, found)
+		assert.Equal(t, uint64(9999), p)
+	}
+
+	_, found := tree.Predecessor(0)
+	assert.False(t, found)
+}
+
+func TestTree_PredecessorSparse(t *testing.T) {
+	tree := NewTree()
+
+	xs := []uint64{3, 1 << 20, 1<<20 + 7, 1 << 40, 1<<63 + 5, 1<<64 - 1}
+	for _, x := range xs {
+		tree.Insert(x)
+	}
+
+	for i, x := range xs {
+		p, found := tree.Predecessor(x)
+		if i == 0 {
+			assert.False(t, found)
+			continue
+		}
+		assert.True(t, found)
+		assert.Equal(t, xs[i-1], p)
+
+		p, found = tree.Predecessor(x - 1)
+		if x-1 == xs[i-1] {
+			continue
+		}
+		assert.True(t, found)
+		assert.Equal(t, xs[i-1], p)
+	}
+}
+
+func TestTree_MinMaxLen(t *testing.T) {
+	tree := NewTree()
+
+	_, found := tree.Min()
+	assert.False(t, found)
+	_, found = tree.Max()
+	assert.False(t, found)
+	assert.Equal(t, 0, tree.Len())
+
+	for x := uint64(100); x < 200; x++ {
+		tree.Insert(x)
+		tree.Insert(x) // duplicated
+	}
+	assert.Equal(t, 100, tree.Len())
+
+	min, _ := tree.Min()
+	max, _ := tree.Max()
+	assert.Equal(t, uint64(100), min)
+	assert.Equal(t, uint64(199), max)
+
+	tree.Delete(100)
+	tree.Delete(199)
+	tree.Delete(150)
+	tree.Delete(150) // deleted
+	tree.Delete(300) // not exist
+	assert.Equal(t, 97, tree.Len())
+
+	min, _ = tree.Min()
+	max, _ = tree.Max()
+	assert.Equal(t, uint64(101), min)
+	assert.Equal(t, uint64(198), max)
+
+	for x := uint64(100); x < 200; x++ {
+		tree.Delete(x)
+	}
+	assert.Equal(t, 0, tree.Len())
+	_, found = tree.Min()
+	assert.False(t, found)
+}
+
+func TestTree_Bits(t *testing.T) {
+	for _, w := range []uint8{1, 2, 3, 5, 7, 12, 13} {
+		tree := NewTreeWithBits(w)
+		u := uint64(1) << w
+
+		// insert odd elements of universe
+		for x := uint64(1); x < u; x += 2 {
+			assert.NoError(t, tree.Insert(x))
+		}
+		assert.Equal(t, ErrOutOfRange, tree.Insert(u))
+		assert.Equal(t, int(u/2), tree.Len(), "w=%d", w)
+
+		for x := uint64(0); x < u; x++ {
+			assert.Equal(t, x%2 == 1, tree.Find(x), "w=%d x=%d", w, x)
+
+			s, found := tree.Successor(x)
+			if x+1+x%2 < u {
+				assert.True(t, found, "w=%d x=%d", w, x)
+				assert.Equal(t, x+1+x%2, s, "w=%d x=%d", w, x)
+			} else {
+				assert.False(t, found, "w=%d x=%d", w, x)
+			}
+
+			p, found := tree.Predecessor(x)
+			if x >= 2+x%2 {
+				assert.True(t, found, "w=%d x=%d", w, x)
+				assert.Equal(t, x-1-x%2, p, "w=%d x=%d", w, x)
+			} else {
+				assert.False(t, found, "w=%d x=%d", w, x)
+			}
+		}
+
+		for x := uint64(1); x < u; x += 2 {
+			tree.Delete(x)
+			assert.False(t, tree.Find(x), "w=%d x=%d", w, x)
+		}
+		assert.Equal(t, 0, tree.Len())
+	}
+}
+
+func TestTree_ClusterHash(t *testing.T) {
+	tree := NewTree(WithClusterStore(ClusterHash))
+	ref := NewTree()
+
+	r := rand.New(rand.NewSource(1))
+	var xs []uint64
+	for i := 0; i < 20000; i++ {
+		x := r.Uint64() >> uint(r.Intn(64))
+		xs = append(xs, x)
+		tree.Insert(x)
+		ref.Insert(x)
+	}
+	for i := 0; i < len(xs); i += 3 {
+		tree.Delete(xs[i])
+		ref.Delete(xs[i])
+	}
+	assert.Equal(t, ref.Len(), tree.Len())
+
+	for _, x := range xs {
+		assert.Equal(t, ref.Find(x), tree.Find(x), "x=%d", x)
+		for _, y := range []uint64{x - 1, x, x + 1} {
+			s1, f1 := ref.Successor(y)
+			s2, f2 := tree.Successor(y)
+			assert.Equal(t, f1, f2, "y=%d", y)
+			assert.Equal(t, s1, s2, "y=%d", y)
+			p1, f1 := ref.Predecessor(y)
+			p2, f2 := tree.Predecessor(y)
+			assert.Equal(t, f1, f2, "y=%d", y)
+			assert.Equal(t, p1, p2, "y=%d", y)
+		}
+	}
+}
+
+func TestHashClusters(t *testing.T) {
+	h := newHashClusters[struct{}]()
+	ref := make(map[uint64]*node[struct{}])
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		c := uint64(r.Intn(2000))
+		if r.Intn(3) == 0 {
+			h.remove(c)
+			delete(ref, c)
+		} else {
+			n := newNode(c, struct{}{}, unitWeight)
+			h.set(c, n)
+			ref[c] = n
+		}
+	}
+
+	assert.Equal(t, len(ref), h.count)
+	for c := uint64(0); c < 2000; c++ {
+		assert.Equal(t, ref[c], h.get(c), "c=%d", c)
+	}
+	n := 0
+	h.each(func(c uint64, nd *node[struct{}]) {
+		assert.Equal(t, ref[c], nd)
+		n++
+	})
+	assert.Equal(t, len(ref), n)
+}
+
+func TestTree_Leaf(t *testing.T) {
+	tree := NewTreeWithBits(8)
+	for x := uint64(0); x < 256; x += 3 {
+		tree.Insert(x)
+	}
+
+	// min/max of root are not stored in leaves
+	assert.Nil(t, tree.root.summary.summary)
+	assert.NotEqual(t, uint64(0), tree.root.summary.mask)
+	tree.root.clusters.each(func(c uint64, n *node[struct{}]) {
+		assert.NotEqual(t, uint64(0), n.mask)
+		assert.Nil(t, n.clusters)
+	})
+
+	r := rand.New(rand.NewSource(1))
+	ref := make(map[uint64]bool)
+	tree = NewTree()
+	for i := 0; i < 100000; i++ {
+		// dense set around a few bases
+		x := uint64(r.Intn(4))<<40 | uint64(r.Intn(1<<14))
+		if r.Intn(4) == 0 {
+			tree.Delete(x)
+			delete(ref, x)
+		} else {
+			tree.Insert(x)
+			ref[x] = true
+		}
+	}
+	assert.Equal(t, len(ref), tree.Len())
+	for x := range ref {
+		assert.True(t, tree.Find(x))
+	}
+
+	n := 0
+	x, found := tree.Min()
+	for found {
+		assert.True(t, ref[x], "x=%d", x)
+		n++
+		x, found = tree.Successor(x)
+	}
+	assert.Equal(t, len(ref), n)
+}
+
+func TestTree_Iterate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, w := range []uint8{5, 8, 13, 32, 64} {
+		tree := NewTreeWithBits(w)
+		ref := make(map[uint64]bool)
+		for i := 0; i < 3000; i++ {
+			x := r.Uint64() & universeMax(w)
+			if w > 16 {
+				x &= 0xffff // keep it dense enough
+				x |= uint64(r.Intn(4)) << (w - 2)
+			}
+			tree.Insert(x)
+			ref[x] = true
+		}
+		var sorted []uint64
+		for x := range ref {
+			sorted = append(sorted, x)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		var all []uint64
+		for x := range tree.All() {
+			all = append(all, x)
+		}
+		assert.Equal(t, sorted, all, "w=%d", w)
+
+		for i := 0; i < 100; i++ {
+			lo := sorted[r.Intn(len(sorted))] + uint64(r.Intn(3)) - 1
+			hi := lo + uint64(r.Intn(1000))
+			var want, got []uint64
+			for _, x := range sorted {
+				if x >= lo && x <= hi {
+					want = append(want, x)
+				}
+			}
+			tree.Range(lo, hi, func(x uint64) bool {
+				got = append(got, x)
+				return true
+			})
+			assert.Equal(t, want, got, "w=%d lo=%d hi=%d", w, lo, hi)
+
+			want, got = nil, nil
+			for _, x := range sorted {
+				if x >= lo {
+					want = append(want, x)
+				}
+			}
+			for x := range tree.Ascend(lo) {
+				got = append(got, x)
+			}
+			assert.Equal(t, want, got, "w=%d lo=%d", w, lo)
+
+			want, got = nil, nil
+			for j := len(sorted) - 1; j >= 0; j-- {
+				if sorted[j] <= hi {
+					want = append(want, sorted[j])
+				}
+			}
+			for x := range tree.Descend(hi) {
+				got = append(got, x)
+			}
+			assert.Equal(t, want, got, "w=%d hi=%d", w, hi)
+		}
+
+		// stop early
+		n := 0
+		for range tree.All() {
+			n++
+			if n == 10 {
+				break
+			}
+		}
+		assert.Equal(t, 10, n)
+	}
+}
+
+func TestTree_AscendFromMin(t *testing.T) {
+	tree := NewTree()
+	tree.Insert(0)
+	tree.Insert(5)
+
+	var got []uint64
+	for x := range tree.Ascend(0) {
+		got = append(got, x)
+	}
+	assert.Equal(t, []uint64{0, 5}, got)
+}
+
+func TestMap(t *testing.T) {
+	for _, w := range []uint8{5, 10, 20, 64} {
+		m := NewMapWithBits[string](w)
+		ref := make(map[uint64]string)
+		r := rand.New(rand.NewSource(int64(w)))
+		universe := 1 << min(w, 12)
+		for i := 0; i < 20000; i++ {
+			k := uint64(r.Intn(universe))
+			switch r.Intn(3) {
+			case 0:
+				v, ok := m.Delete(k)
+				rv, rok := ref[k]
+				assert.Equal(t, rok, ok, "w=%d k=%d", w, k)
+				assert.Equal(t, rv, v, "w=%d k=%d", w, k)
+				delete(ref, k)
+			default:
+				v := fmt.Sprint(k, "-", i)
+				assert.NoError(t, m.Put(k, v))
+				ref[k] = v
+			}
+		}
+		assert.Equal(t, len(ref), m.Len())
+
+		keys := make([]uint64, 0, len(ref))
+		for k := range ref {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+		for k := 0; k < universe; k++ {
+			v, ok := m.Get(uint64(k))
+			rv, rok := ref[uint64(k)]
+			assert.Equal(t, rok, ok, "w=%d k=%d", w, k)
+			assert.Equal(t, rv, v, "w=%d k=%d", w, k)
+
+			j := sort.Search(len(keys), func(j int) bool { return keys[j] > uint64(k) })
+			sk, sv, ok := m.SuccessorEntry(uint64(k))
+			if assert.Equal(t, j < len(keys), ok, "w=%d k=%d", w, k) && ok {
+				assert.Equal(t, keys[j], sk)
+				assert.Equal(t, ref[keys[j]], sv)
+			}
+			j = sort.Search(len(keys), func(j int) bool { return keys[j] >= uint64(k) }) - 1
+			pk, pv, ok := m.PredecessorEntry(uint64(k))
+			if assert.Equal(t, j >= 0, ok, "w=%d k=%d", w, k) && ok {
+				assert.Equal(t, keys[j], pk)
+				assert.Equal(t, ref[keys[j]], pv)
+			}
+		}
+
+		i := 0
+		for k, v := range m.All() {
+			assert.Equal(t, keys[i], k)
+			assert.Equal(t, ref[k], v)
+			i++
+		}
+		assert.Equal(t, len(keys), i)
+	}
+
+	m := NewMapWithBits[int](4)
+	assert.ErrorIs(t, m.Put(16, 1), ErrOutOfRange)
+}
+
+func TestBuildFromSorted(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var keys []uint64
+	for i := 0; i < 100000; i++ {
+		// dense runs around a few bases plus sparse keys, with duplicates
+		switch r.Intn(3) {
+		case 0:
+			keys = append(keys, r.Uint64())
+		default:
+			keys = append(keys, uint64(r.Intn(8))<<36|uint64(r.Intn(1<<16)))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, store := range []ClusterStore{ClusterMap, ClusterHash} {
+		built := BuildFromSorted(keys, WithClusterStore(store))
+		tree := NewTree(WithClusterStore(store))
+		for _, x := range keys {
+			tree.Insert(x)
+		}
+
+		assert.Equal(t, tree.Len(), built.Len())
+		assert.Equal(t, slices.Collect(tree.All()), slices.Collect(built.All()))
+		for i := 0; i < 10000; i++ {
+			x := keys[r.Intn(len(keys))] + uint64(r.Intn(3)) - 1
+			s1, f1 := tree.Successor(x)
+			s2, f2 := built.Successor(x)
+			assert.Equal(t, f1, f2, "x=%d", x)
+			assert.Equal(t, s1, s2, "x=%d", x)
+			p1, f1 := tree.Predecessor(x)
+			p2, f2 := built.Predecessor(x)
+			assert.Equal(t, f1, f2, "x=%d", x)
+			assert.Equal(t, p1, p2, "x=%d", x)
+		}
+
+		// built tree stays mutable
+		for _, x := range keys[:len(keys)/2] {
+			built.Delete(x)
+			tree.Delete(x)
+		}
+		assert.Equal(t, tree.Len(), built.Len())
+		assert.Equal(t, slices.Collect(tree.All()), slices.Collect(built.All()))
+	}
+
+	assert.Equal(t, 0, BuildFromSorted(nil).Len())
+	assert.Panics(t, func() { BuildFromSorted([]uint64{1, 3, 2}) })
+	assert.Panics(t, func() { BuildFromSorted([]uint64{1, 1, 3, 2}) })
+}
+
+func TestTree_SetOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, w := range []uint8{6, 10, 20, 64} {
+		for round := 0; round < 20; round++ {
+			a, b := NewTreeWithBits(w), NewTreeWithBits(w, WithClusterStore(ClusterHash))
+			refA, refB := make(map[uint64]bool), make(map[uint64]bool)
+			universe := 1 << min(w, 12)
+			// vary density, including empty trees
+			for _, p := range []struct {
+				tree *Tree
+				ref  map[uint64]bool
+			}{{a, refA}, {b, refB}} {
+				n := r.Intn(universe / 2)
+				if round%5 == 0 {
+					n = r.Intn(3)
+				}
+				for i := 0; i < n; i++ {
+					x := uint64(r.Intn(universe))
+					p.tree.Insert(x)
+					p.ref[x] = true
+				}
+			}
+
+			for _, tc := range []struct {
+				name string
+				fn   func(a, b *Tree) (*Tree, error)
+				keep func(inA, inB bool) bool
+			}{
+				{"union", Union, func(inA, inB bool) bool { return inA || inB }},
+				{"intersect", Intersect, func(inA, inB bool) bool { return inA && inB }},
+				{"difference", Difference, func(inA, inB bool) bool { return inA && !inB }},
+				{"symmetric", SymmetricDifference, func(inA, inB bool) bool { return inA != inB }},
+			} {
+				got, err := tc.fn(a, b)
+				assert.NoError(t, err)
+				want := NewTreeWithBits(w)
+				for x := 0; x < universe; x++ {
+					if tc.keep(refA[uint64(x)], refB[uint64(x)]) {
+						want.Insert(uint64(x))
+					}
+				}
+				assert.Equal(t, slices.Collect(want.All()), slices.Collect(got.All()), "w=%d %s", w, tc.name)
+				assert.Equal(t, want.Len(), got.Len(), "w=%d %s", w, tc.name)
+				assert.True(t, Equal(want, got), "w=%d %s", w, tc.name)
+
+				// result does not share nodes with operands
+				for x := range want.All() {
+					got.Delete(x)
+				}
+				assert.Len(t, slices.Collect(a.All()), len(refA))
+				assert.Len(t, slices.Collect(b.All()), len(refB))
+			}
+		}
+	}
+
+	a, b := NewTree(), NewTree()
+	a.Insert(1)
+	a.Insert(5)
+	assert.False(t, Equal(a, b))
+	b.Insert(5)
+	b.Insert(1)
+	assert.True(t, Equal(a, b))
+	_, err := Union(a, NewTreeWithBits(32))
+	assert.ErrorIs(t, err, ErrUniverseMismatch)
+	assert.False(t, Equal(NewTree(), NewTreeWithBits(32)))
+}
+
+func TestTree_RankSelect(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, w := range []uint8{5, 10, 20, 64} {
+		tree := NewTreeWithBits(w)
+		ref := make(map[uint64]bool)
+		universe := 1 << min(w, 12)
+		for i := 0; i < 5000; i++ {
+			x := uint64(r.Intn(universe))
+			if r.Intn(3) == 0 {
+				tree.Delete(x)
+				delete(ref, x)
+			} else {
+				tree.Insert(x)
+				ref[x] = true
+			}
+		}
+		var sorted []uint64
+		for x := range ref {
+			sorted = append(sorted, x)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		for x := 0; x <= universe; x++ {
+			want := sort.Search(len(sorted), func(j int) bool { return sorted[j] >= uint64(x) })
+			assert.Equal(t, want, tree.Rank(uint64(x)), "w=%d x=%d", w, x)
+		}
+		for k, want := range sorted {
+			got, ok := tree.Select(k)
+			assert.True(t, ok)
+			assert.Equal(t, want, got, "w=%d k=%d", w, k)
+		}
+		_, ok := tree.Select(len(sorted))
+		assert.False(t, ok)
+		_, ok = tree.Select(-1)
+		assert.False(t, ok)
+		checkCounts(t, tree.root, w, unitWeight)
+	}
+
+	// counts of built and combined trees
+	keys := []uint64{1, 2, 3, 100, 1 << 40, 1<<40 + 7, 1 << 63}
+	a := BuildFromSorted(keys)
+	b := BuildFromSorted(keys[2:5])
+	for k, x := range keys {
+		assert.Equal(t, k, a.Rank(x))
+		got, _ := a.Select(k)
+		assert.Equal(t, x, got)
+	}
+	d, _ := Difference(a, b)
+	assert.Equal(t, 3, d.Rank(1<<63))
+	got, _ := d.Select(2)
+	assert.Equal(t, uint64(1<<40+7), got)
+	checkCounts(t, a.root, a.bits, unitWeight)
+	checkCounts(t, d.root, d.bits, unitWeight)
+}
+
+// sparseTree tree of n random elements, whose root has about as many clusters as elements
+func sparseTree(r *rand.Rand, n int) *Tree {
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = r.Uint64()
+	}
+	slices.Sort(keys)
+	return BuildFromSorted(keys)
+}
+
+func TestTree_RankSelectSparse(t *testing.T) {
+	// Rank/Select go down through weighted summary instead of scanning clusters of root
+	r := rand.New(rand.NewSource(1))
+	tree := sparseTree(r, 1<<14)
+	checkCounts(t, tree.root, tree.bits, unitWeight)
+	for k := 0; k < tree.Len(); k += 7 {
+		x, ok := tree.Select(k)
+		assert.True(t, ok)
+		assert.Equal(t, k, tree.Rank(x))
+	}
+}
+
+func BenchmarkTree_RankSelect(b *testing.B) {
+	// cost per query shouldn't grow with number of clusters of root
+	for _, n := range []int{1 << 10, 1 << 17} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			tree := sparseTree(r, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				k := r.Intn(tree.Len())
+				x, _ := tree.Select(k)
+				if tree.Rank(x) != k {
+					b.Fatalf("n=%d k=%d x=%d rank=%d", n, k, x, tree.Rank(x))
+				}
+			}
+		})
+	}
+}
+
+// checkCounts assert count of each node is total weight of its elements, and summary holds counts of clusters
+func checkCounts[V any](t *testing.T, n *node[V], width uint8, w weigher[V]) {
+	if n == nil {
+		return
+	}
+	total := 0
+	if isLeaf(width) {
+		for x := uint64(0); x < 64; x++ {
+			if n.mask&(1<<x) != 0 {
+				total += w(n.vals[x])
+			}
+		}
+		assert.Equal(t, total, n.count)
+		return
+	}
+
+	total = w(n.minVal)
+	if n.max != n.min {
+		total += w(n.maxVal)
+	}
+	for _, c := range clusterIndexes(n, width) {
+		cluster := n.clusters.get(c)
+		weight, _ := find(n.summary, c, highBits(width))
+		assert.Equal(t, cluster.count, weight)
+		total += cluster.count
+		checkCounts(t, cluster, lowBits(width), w)
+	}
+	checkCounts(t, n.summary, highBits(width), clusterWeight)
+	assert.Equal(t, total, n.count)
+}
+
+func TestTree_Binary(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, w := range []uint8{1, 6, 13, 32, 64} {
+		for _, n := range []int{0, 1, 2, 3, 5000} {
+			tree := NewTreeWithBits(w, WithClusterStore(ClusterHash))
+			for i := 0; i < n; i++ {
+				tree.Insert(r.Uint64() & universeMax(w))
+			}
+			tree.Insert(universeMax(w))
+
+			data, err := tree.MarshalBinary()
+			assert.NoError(t, err)
+			var got Tree
+			assert.NoError(t, got.UnmarshalBinary(data))
+			assert.True(t, Equal(tree, &got), "w=%d n=%d", w, n)
+			assert.Equal(t, ClusterHash, got.store)
+
+			// decoded tree stays mutable
+			got.Insert(0)
+			tree.Insert(0)
+			assert.True(t, Equal(tree, &got), "w=%d n=%d", w, n)
+		}
+	}
+
+	tree := BuildFromSorted([]uint64{3, 7, 1 << 40})
+	data, _ := tree.MarshalBinary()
+	var got Tree
+	assert.ErrorIs(t, got.UnmarshalBinary(data[:len(data)-1]), ErrCorrupted)
+	assert.ErrorIs(t, got.UnmarshalBinary(append(data, 0)), ErrCorrupted)
+	assert.ErrorIs(t, got.UnmarshalBinary(data[:2]), ErrCorrupted)
+
+	bad := slices.Clone(data)
+	bad[3] = binaryVersion + 1
+	assert.ErrorIs(t, got.UnmarshalBinary(bad), ErrBadVersion)
+
+	// zero delta means duplicate element
+	bad = slices.Clone(data)
+	bad[8] = 0 // delta of 7
+	assert.ErrorIs(t, got.UnmarshalBinary(bad), ErrCorrupted)
+
+	small := NewTreeWithBits(4)
+	small.Insert(15)
+	data, _ = small.MarshalBinary()
+	data[4] = 3 // 15 is out of universe of 3 bits
+	assert.ErrorIs(t, got.UnmarshalBinary(data), ErrCorrupted)
+}